@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// taskPublisher delivers a single json encoded Task to Totem. It is satisfied
+// by amqpPublisher and by anything that stands in for a broker.
+type taskPublisher interface {
+	Publish(body []byte) error
+	Close() error
+}
+
+// amqpChannel is the part of *amqp.Channel used for publishing, so that a
+// stand-in can confirm or return messages in tests
+type amqpChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// amqpPublisher publishes tasks directly to the Totem input queue, the same
+// way test-scripts/totem_tasking_test.py does. Every message is persistent
+// and only counts as sent, once the broker confirmed it. Mandatory messages,
+// i.e. tasks, have to be routed to a queue as well.
+type amqpPublisher struct {
+	conn       *amqp.Connection // nil for a stand-in channel
+	channel    amqpChannel
+	confirms   chan amqp.Confirmation
+	returns    chan amqp.Return
+	exchange   string
+	routingKey string
+	mandatory  bool
+}
+
+// publisher is created on first use, when tasking via AMQP
+var publisher taskPublisher
+
+func newAMQPPublisher(uri, exchange, queue, routingKey string) (*amqpPublisher, error) {
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if queue != "" {
+		_, err = channel.QueueDeclare(queue, true, false, false, false, nil)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		// without an exchange, messages are routed by queue name
+		if exchange == "" && routingKey == "" {
+			routingKey = queue
+		}
+		if exchange != "" {
+			// the exchange is Totem's, it has to exist already
+			err = channel.QueueBind(queue, routingKey, exchange, false, nil)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("can't bind %s to the exchange %s: %s", queue, exchange, err)
+			}
+		}
+	}
+
+	return confirmPublisher(conn, channel, exchange, routingKey, true)
+}
+
+// newEventPublisher publishes the events of the "amqp" sink. The exchange is
+// the toolbox's own, so it is declared as a durable topic exchange. Events
+// nobody subscribed to are dropped by the broker instead of failing.
+func newEventPublisher(uri, exchange, routingKey string) (*amqpPublisher, error) {
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the default exchange can't be declared, it routes by queue name
+	if exchange != "" {
+		err = channel.ExchangeDeclare(exchange, "topic", true, false, false, false, nil)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("can't declare the exchange %s: %s", exchange, err)
+		}
+	}
+	return confirmPublisher(conn, channel, exchange, routingKey, false)
+}
+
+// confirmPublisher puts the channel into confirm mode and publishes with it
+func confirmPublisher(conn *amqp.Connection, channel *amqp.Channel, exchange, routingKey string, mandatory bool) (*amqpPublisher, error) {
+	err := channel.Confirm(false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &amqpPublisher{
+		conn:       conn,
+		channel:    channel,
+		confirms:   channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:    channel.NotifyReturn(make(chan amqp.Return, 1)),
+		exchange:   exchange,
+		routingKey: routingKey,
+		mandatory:  mandatory,
+	}, nil
+}
+
+func (p *amqpPublisher) Publish(body []byte) error {
+	err := p.channel.Publish(p.exchange, p.routingKey, p.mandatory, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	})
+	if err != nil {
+		return err
+	}
+
+	confirm, ok := <-p.confirms
+	if !ok {
+		return errors.New("channel closed before the broker confirmed the task")
+	}
+	if !confirm.Ack {
+		return fmt.Errorf("broker rejected task #%d", confirm.DeliveryTag)
+	}
+
+	// unroutable messages are returned before they are confirmed
+	select {
+	case ret := <-p.returns:
+		return fmt.Errorf("task could not be routed: %s", ret.ReplyText)
+	default:
+	}
+	return nil
+}
+
+func (p *amqpPublisher) Close() error {
+	p.channel.Close()
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.Close()
+}
+
+// publishTasks sends each task as its own message, as Totem expects exactly
+// one task per message.
+func publishTasks(allTasks []Task) error {
+	if publisher == nil {
+		p, err := newAMQPPublisher(options.AMQPURI, options.Exchange, options.Queue, options.RoutingKey)
+		if err != nil {
+			return err
+		}
+		publisher = p
+	}
+
+	for i := range allTasks {
+		task := allTasks[i]
+		if options.SampleURI != "" {
+			// Totem downloads the sample itself, so it needs the full URI
+			task.SecondaryURI = options.SampleURI + task.PrimaryURI
+			task.PrimaryURI = task.SecondaryURI
+		}
+
+		jsoned, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		debug.Printf("Publishing task: %s\n", jsoned)
+
+		err = publisher.Publish(jsoned)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resultConsumer receives Totem's results from a private, exclusive queue
+// bound to the results exchange. The regular results queue is left alone, so
+// that Holmes-Storage still gets every result, and the private queue only
+// holds copies, that can be dropped, if they belong to another run.
+type resultConsumer struct {
+	conn       *amqp.Connection
+	channel    *amqp.Channel
+	deliveries <-chan amqp.Delivery
+}
+
+func newResultConsumer(uri, exchange, routingKey string) (*resultConsumer, error) {
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	q, err := channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = channel.QueueBind(q.Name, routingKey, exchange, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("can't bind a queue to the exchange %s: %s", exchange, err)
+	}
+
+	deliveries, err := channel.Consume(q.Name, "", false, true, false, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &resultConsumer{
+		conn:       conn,
+		channel:    channel,
+		deliveries: deliveries,
+	}, nil
+}
+
+// settle acknowledges a delivery, that could be parsed, no matter whether it
+// belongs to this run. A body that can't be parsed is rejected without
+// requeueing it, it would only be delivered again.
+func (c *resultConsumer) settle(d amqp.Delivery, parsed bool) {
+	var err error
+	if parsed {
+		err = d.Ack(false)
+	} else {
+		err = d.Reject(false)
+	}
+	if err != nil {
+		warning.Println("Couldn't acknowledge result:", err)
+	}
+}
+
+func (c *resultConsumer) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	c.channel.Close()
+	return c.conn.Close()
+}
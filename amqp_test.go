@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// recordingPublisher stands in for the broker in publishTasks
+type recordingPublisher struct {
+	bodies [][]byte
+	err    error // returned by every Publish
+}
+
+func (p *recordingPublisher) Publish(body []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.bodies = append(p.bodies, body)
+	return nil
+}
+
+func (p *recordingPublisher) Close() error { return nil }
+
+func TestPublishTasks(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	options.SampleURI = "http://storage:8016/samples/"
+	p := &recordingPublisher{}
+	publisher = p
+
+	tasks := []Task{
+		{PrimaryURI: "aaaa", Filename: "a.exe", Tasks: map[string][]string{"PEINFO": {}}, Download: true},
+		{PrimaryURI: "bbbb", Filename: "b.exe", Tasks: map[string][]string{"YARA": {}}, Download: true},
+	}
+	if err := publishTasks(tasks); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.bodies) != 2 {
+		t.Fatalf("published %d messages, want one per task", len(p.bodies))
+	}
+	for i, body := range p.bodies {
+		var got Task
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		uri := options.SampleURI + tasks[i].PrimaryURI
+		if got.PrimaryURI != uri || got.SecondaryURI != uri || got.Filename != tasks[i].Filename || !reflect.DeepEqual(got.Tasks, tasks[i].Tasks) {
+			t.Errorf("message %d = %+v, want the task with the URI %s", i, got, uri)
+		}
+	}
+	if tasks[0].PrimaryURI != "aaaa" {
+		t.Errorf("the tasks of the caller were changed to %q", tasks[0].PrimaryURI)
+	}
+
+	publisher = &recordingPublisher{err: errors.New("connection closed")}
+	if err := publishTasks(tasks); err == nil || !strings.Contains(err.Error(), "connection closed") {
+		t.Errorf("publishTasks = %v, want the error of the broker", err)
+	}
+}
+
+// fakeChannel answers every message the way the broker would, with a
+// return (if routed is false) followed by a confirmation
+type fakeChannel struct {
+	p      *amqpPublisher
+	ack    bool
+	routed bool
+	closed bool // the channel is closed before confirming
+	sent   []amqp.Publishing
+}
+
+func (c *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.sent = append(c.sent, msg)
+	if c.closed {
+		close(c.p.confirms)
+		return nil
+	}
+	if !c.routed && mandatory {
+		c.p.returns <- amqp.Return{ReplyText: "NO_ROUTE"}
+	}
+	c.p.confirms <- amqp.Confirmation{DeliveryTag: uint64(len(c.sent)), Ack: c.ack}
+	return nil
+}
+
+func (c *fakeChannel) Close() error { return nil }
+
+func TestAMQPPublisherConfirms(t *testing.T) {
+	tests := []struct {
+		name      string
+		channel   *fakeChannel
+		mandatory bool
+		wantErr   string
+	}{
+		{"confirmed", &fakeChannel{ack: true, routed: true}, true, ""},
+		{"rejected", &fakeChannel{ack: false, routed: true}, true, "broker rejected task #1"},
+		{"returned", &fakeChannel{ack: true, routed: false}, true, "could not be routed: NO_ROUTE"},
+		{"closed", &fakeChannel{closed: true}, true, "channel closed"},
+		// events of the "amqp" sink nobody subscribed to are dropped
+		{"unrouted event", &fakeChannel{ack: true, routed: false}, false, ""},
+	}
+	for _, tt := range tests {
+		p := &amqpPublisher{
+			channel:   tt.channel,
+			confirms:  make(chan amqp.Confirmation, 1),
+			returns:   make(chan amqp.Return, 1),
+			mandatory: tt.mandatory,
+		}
+		tt.channel.p = p
+		err := p.Publish([]byte(`{}`))
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: Publish = %v, want %q", tt.name, err, tt.wantErr)
+		}
+		if msg := tt.channel.sent[0]; msg.DeliveryMode != amqp.Persistent || msg.ContentType != "application/json" {
+			t.Errorf("%s: message %+v is not persistent json", tt.name, msg)
+		}
+		p.Close()
+	}
+}
+
+// fakeAcknowledger records how the deliveries of a consumer were settled
+type fakeAcknowledger struct {
+	acked, requeued, rejected []uint64
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	if requeue {
+		a.requeued = append(a.requeued, tag)
+	} else {
+		a.rejected = append(a.rejected, tag)
+	}
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestResultConsumer(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	options.ResultsOut = "results.jsonl"
+	options.WaitTimeout = time.Minute
+
+	acker := &fakeAcknowledger{}
+	deliveries := make(chan amqp.Delivery, 3)
+	for i, body := range []string{
+		`{"sha256":"cccc","service_name":"peinfo","data":"{}"}`, // another run
+		`{"sha256":"aaaa","service_name":"peinfo","data":"{}"}`,
+		`not json`,
+	} {
+		deliveries <- amqp.Delivery{Acknowledger: acker, DeliveryTag: uint64(i + 1), Body: []byte(body)}
+	}
+	close(deliveries)
+
+	tasks := []Task{
+		{PrimaryURI: "aaaa", Tasks: map[string][]string{"PEINFO": {}}},
+		{PrimaryURI: "bbbb", Tasks: map[string][]string{"YARA": {}}},
+	}
+	waitForResults(tasks, &resultConsumer{deliveries: deliveries})
+
+	// nothing goes back to the queue, where it would be delivered again
+	if !reflect.DeepEqual(acker.acked, []uint64{1, 2}) || !reflect.DeepEqual(acker.rejected, []uint64{3}) || acker.requeued != nil {
+		t.Errorf("acked %v, rejected %v and requeued %v, want [1 2], [3] and none", acker.acked, acker.rejected, acker.requeued)
+	}
+	out, err := ioutil.ReadFile("results.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(out)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"sha256":"aaaa"`) {
+		t.Errorf("results = %q, want only the one of aaaa", out)
+	}
+}
+
+func TestResultConsumerInterrupted(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	options.ResultsOut = "results.jsonl"
+	options.WaitTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	saved := rootCtx
+	rootCtx = ctx
+	defer func() { rootCtx = saved }()
+	cancel()
+	var logged bytes.Buffer
+	warning = log.New(&logged, "", 0)
+
+	done := make(chan struct{})
+	go func() {
+		waitForResults([]Task{{PrimaryURI: "aaaa", Tasks: map[string][]string{"PEINFO": {}}}}, &resultConsumer{deliveries: make(chan amqp.Delivery)})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting for results went on after the interrupt")
+	}
+	if !strings.Contains(logged.String(), "PEINFO (1 samples): aaaa") {
+		t.Errorf("log = %q, want the pending sample", logged.String())
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// carvedObject is a file that was transferred in a connection of a capture
+type carvedObject struct {
+	name    string
+	comment string
+	tags    []string
+	content []byte
+}
+
+// readPCAP uploads the objects transferred over HTTP, SMTP and FTP in the
+// capture of "-pcap". Connections are reassembled in memory, so the whole
+// capture has to fit into it.
+func readPCAP(in *input) {
+	f, err := os.Open(options.PCAP)
+	if err != nil {
+		warning.Println("Couldn't open capture:", err)
+		return
+	}
+	conns, err := reassembleTCP(f)
+	f.Close()
+	if err != nil {
+		// the connections read so far are still carved
+		warning.Println("pcap error:", err)
+	}
+	debug.Printf("Read %d TCP connections from %s\n", len(conns), options.PCAP)
+
+	capture := filepath.Base(options.PCAP)
+	transfers := ftpTransfers(conns)
+	for _, conn := range conns {
+		if cancelled() {
+			return
+		}
+		if !conn.complete {
+			debug.Printf("Connection %d (%s -> %s) misses segments, objects after the gap are lost\n", conn.index, conn.client, conn.server)
+		}
+
+		// tags describe the control connection of FTP transfers
+		proto, flow := "", conn
+		var objects []carvedObject
+		if t, ok := transfers[conn]; ok {
+			proto, flow, objects = "ftp", t.control, carveFTPData(conn, t)
+		} else if isHTTP(conn.clientToServer) {
+			proto, objects = "http", carveHTTP(conn)
+		} else if isSMTP(conn.clientToServer) {
+			proto, objects = "smtp", carveSMTP(conn)
+		} else {
+			continue
+		}
+
+		for i, o := range objects {
+			meta := sampleMeta{
+				Name:    o.name,
+				Comment: o.comment,
+				Tags:    append(flowTags(flow, proto), o.tags...),
+			}
+			if options.DateFrom == "mtime" {
+				// files of a capture have no mtime, the connection has a time
+				meta.Date = conn.start
+			}
+			name := fmt.Sprintf("%s/%d/%s/%d/%s", capture, conn.index, proto, i+1, o.name)
+			queueStreamEntry(in, "pcap", name, &streamEntry{content: o.content, meta: meta})
+		}
+	}
+}
+
+// flowTags describe the connection an object was transferred in
+func flowTags(conn *tcpConn, proto string) []string {
+	return []string{
+		"protocol:" + proto,
+		"src-ip:" + conn.client.ip.String(),
+		"dst-ip:" + conn.server.ip.String(),
+		"dst-port:" + strconv.Itoa(int(conn.server.port)),
+	}
+}
+
+// objectName returns a filename that is safe to use in a sample name
+func objectName(name, fallback string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return fallback
+	}
+	return name
+}
+
+// firstWord returns the upper-cased command of the first line of a stream
+func firstWord(stream []byte) string {
+	if i := bytes.IndexAny(stream, " \r\n"); i > 0 {
+		return strings.ToUpper(string(stream[:i]))
+	}
+	return ""
+}
+
+func isHTTP(stream []byte) bool {
+	switch firstWord(stream) {
+	case "GET", "POST", "PUT", "HEAD", "OPTIONS", "DELETE", "PATCH", "TRACE", "CONNECT":
+		return true
+	}
+	return false
+}
+
+func isSMTP(stream []byte) bool {
+	switch firstWord(stream) {
+	case "EHLO", "HELO":
+		return true
+	}
+	return false
+}
+
+func isFTP(conn *tcpConn) bool {
+	if !bytes.HasPrefix(conn.serverToClient, []byte("220")) {
+		return false
+	}
+	switch firstWord(conn.clientToServer) {
+	case "USER", "AUTH", "FEAT", "SYST", "OPTS":
+		return true
+	}
+	return false
+}
+
+// carveHTTP returns the bodies of all responses, and the files uploaded with
+// PUT or as multipart forms. Truncated bodies are dropped.
+func carveHTTP(conn *tcpConn) []carvedObject {
+	var objects []carvedObject
+	requests := bufio.NewReader(bytes.NewReader(conn.clientToServer))
+	responses := bufio.NewReader(bytes.NewReader(conn.serverToClient))
+	for {
+		req, err := http.ReadRequest(requests)
+		if err != nil {
+			return objects
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return objects
+		}
+		host, tags := req.Host, []string{"host:" + req.Host}
+		if host == "" {
+			// HTTP/1.0 without a Host header
+			host, tags = conn.server.String(), nil
+		}
+		comment := fmt.Sprintf("%s http://%s%s", req.Method, host, req.RequestURI)
+
+		switch {
+		case req.Method == "PUT" && len(body) > 0:
+			objects = append(objects, carvedObject{
+				name:    objectName(req.URL.Path, "upload"),
+				comment: comment,
+				tags:    tags,
+				content: body,
+			})
+		case req.Method == "POST":
+			for _, o := range multipartFiles(req.Header.Get("Content-Type"), body) {
+				o.comment, o.tags = comment, tags
+				objects = append(objects, o)
+			}
+		}
+
+		var resp *http.Response
+		for {
+			resp, err = http.ReadResponse(responses, req)
+			if err != nil {
+				return objects
+			}
+			if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+				break
+			}
+			// informational responses precede the final one
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// not http anymore, e.g. websockets
+			return objects
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return objects
+		}
+		if len(body) == 0 {
+			continue
+		}
+
+		name := ""
+		if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+			name = params["filename"]
+		}
+		if name == "" {
+			name = req.URL.Path
+		}
+		objects = append(objects, carvedObject{
+			name:    objectName(name, "index"),
+			comment: comment,
+			tags:    tags,
+			content: decodeContentEncoding(resp.Header.Get("Content-Encoding"), body),
+		})
+	}
+}
+
+// multipartFiles returns the file parts of a multipart form
+func multipartFiles(contentType string, body []byte) []carvedObject {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil
+	}
+	var objects []carvedObject
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return objects
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			return objects
+		}
+		objects = append(objects, carvedObject{name: objectName(part.FileName(), "upload"), content: content})
+	}
+}
+
+// decodeContentEncoding undoes gzip and deflate, bodies that can't be decoded
+// are returned as they are
+func decodeContentEncoding(encoding string, body []byte) []byte {
+	var r io.Reader
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// usually zlib, some servers send raw deflate
+		r, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return body
+	}
+	if err != nil {
+		return body
+	}
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
+
+// carveSMTP returns the attachments of all mails sent in a connection
+func carveSMTP(conn *tcpConn) []carvedObject {
+	var (
+		objects []carvedObject
+		from    string
+		rcpt    []string
+	)
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(conn.clientToServer)))
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return objects
+		}
+		upper := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(upper, "MAIL FROM:"):
+			from, rcpt = smtpAddress(line[len("MAIL FROM:"):]), nil
+		case strings.HasPrefix(upper, "RCPT TO:"):
+			rcpt = append(rcpt, smtpAddress(line[len("RCPT TO:"):]))
+		case upper == "DATA":
+			raw, err := r.ReadDotBytes()
+			if err != nil {
+				// the mail is truncated
+				return objects
+			}
+			msg, attachments, err := mailAttachments(raw)
+			if err != nil {
+				debug.Printf("Invalid mail in connection %d: %s\n", conn.index, err)
+			}
+			if msg == nil {
+				continue
+			}
+			info := describeMail(msg)
+			comment := info.comment(fmt.Sprintf("%s to %s", from, strings.Join(rcpt, ", ")))
+			for _, a := range attachments {
+				objects = append(objects, carvedObject{
+					name:    objectName(a.Name, "attachment"),
+					comment: comment,
+					tags:    info.tags(),
+					content: a.Content,
+				})
+			}
+		case upper == "STARTTLS":
+			// the rest is encrypted
+			return objects
+		}
+	}
+}
+
+// smtpAddress strips the brackets and parameters of a MAIL FROM or RCPT TO
+func smtpAddress(arg string) string {
+	arg = strings.TrimSpace(arg)
+	if i := strings.Index(arg, ">"); strings.HasPrefix(arg, "<") && i > 0 {
+		return arg[1:i]
+	}
+	return strings.Fields(arg + " ")[0]
+}
+
+// ftpTransfer is a file sent over an FTP data connection
+type ftpTransfer struct {
+	control *tcpConn
+	command string // RETR, STOR, STOU or APPE
+	name    string
+}
+
+// the h1,h2,h3,h4,p1,p2 address of PORT and PASV
+var ftpPASV = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+
+// ftpTransfers finds the data connections of all FTP control connections.
+// Data connections are matched by the address their server listened on.
+func ftpTransfers(conns []*tcpConn) map[*tcpConn]ftpTransfer {
+	byAddress := map[string]ftpTransfer{}
+	for _, conn := range conns {
+		if !isFTP(conn) {
+			continue
+		}
+
+		// passive mode addresses, in the order of the replies
+		var passive []string
+		replies := textproto.NewReader(bufio.NewReader(bytes.NewReader(conn.serverToClient)))
+		for {
+			line, err := replies.ReadLine()
+			if err != nil {
+				break
+			}
+			switch {
+			case strings.HasPrefix(line, "227 "):
+				if m := ftpPASV.FindStringSubmatch(line); m != nil {
+					passive = append(passive, ftpAddress(m[1:]))
+				}
+			case strings.HasPrefix(line, "229 "):
+				if port := epsvPort(line); port != "" {
+					passive = append(passive, net.JoinHostPort(conn.server.ip.String(), port))
+				}
+			}
+		}
+
+		address := ""
+		commands := textproto.NewReader(bufio.NewReader(bytes.NewReader(conn.clientToServer)))
+		for {
+			line, err := commands.ReadLine()
+			if err != nil {
+				break
+			}
+			command, arg := strings.ToUpper(line), ""
+			if i := strings.IndexByte(line, ' '); i >= 0 {
+				command, arg = strings.ToUpper(line[:i]), line[i+1:]
+			}
+			switch command {
+			case "PASV", "EPSV":
+				if len(passive) > 0 {
+					address, passive = passive[0], passive[1:]
+				}
+			case "PORT":
+				if m := ftpPASV.FindStringSubmatch(arg); m != nil {
+					address = ftpAddress(m[1:])
+				}
+			case "EPRT":
+				// |protocol|address|port|, with any delimiter
+				if len(arg) > 1 {
+					if fields := strings.Split(arg, arg[:1]); len(fields) >= 4 {
+						address = net.JoinHostPort(fields[2], fields[3])
+					}
+				}
+			case "RETR", "STOR", "STOU", "APPE":
+				if address != "" {
+					byAddress[address] = ftpTransfer{control: conn, command: command, name: arg}
+				}
+				address = ""
+			case "LIST", "NLST", "MLSD":
+				// directory listings are not samples
+				address = ""
+			}
+		}
+	}
+
+	transfers := map[*tcpConn]ftpTransfer{}
+	if len(byAddress) == 0 {
+		return transfers
+	}
+	for _, conn := range conns {
+		// without a handshake, the sides of a connection are guessed
+		if t, ok := byAddress[conn.server.String()]; ok {
+			transfers[conn] = t
+		} else if t, ok := byAddress[conn.client.String()]; ok {
+			transfers[conn] = t
+		}
+	}
+	return transfers
+}
+
+// ftpAddress formats the h1,h2,h3,h4,p1,p2 of PORT and PASV as host:port
+func ftpAddress(fields []string) string {
+	p1, _ := strconv.Atoi(fields[4])
+	p2, _ := strconv.Atoi(fields[5])
+	ip := strings.Join(fields[:4], ".")
+	return net.JoinHostPort(net.ParseIP(ip).String(), strconv.Itoa(p1*256+p2))
+}
+
+// epsvPort returns the port of a reply like "229 Entering Extended Passive
+// Mode (|||6446|)"
+func epsvPort(line string) string {
+	start, end := strings.IndexByte(line, '('), strings.LastIndexByte(line, ')')
+	if start < 0 || end < start+5 {
+		return ""
+	}
+	inner := line[start+1 : end]
+	fields := strings.Split(inner, inner[:1])
+	if len(fields) < 5 {
+		return ""
+	}
+	if _, err := strconv.Atoi(fields[3]); err != nil {
+		return ""
+	}
+	return fields[3]
+}
+
+// carveFTPData returns the file of a data connection, it is sent in one
+// direction only
+func carveFTPData(conn *tcpConn, t ftpTransfer) []carvedObject {
+	content := conn.serverToClient
+	if len(content) == 0 {
+		content = conn.clientToServer
+	}
+	if len(content) == 0 || !conn.complete {
+		return nil
+	}
+	return []carvedObject{{
+		name:    objectName(t.name, "ftp-data"),
+		comment: fmt.Sprintf("%s %s ftp://%s", t.command, t.name, t.control.server),
+		content: content,
+	}}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pcapWriter builds a classic pcap of Ethernet frames in memory
+type pcapWriter struct {
+	bytes.Buffer
+	ts time.Time
+}
+
+func newPcapWriter() *pcapWriter {
+	w := &pcapWriter{ts: time.Date(2020, 5, 4, 12, 0, 0, 0, time.UTC)}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkEthernet)
+	w.Write(header)
+	return w
+}
+
+// packet writes a TCP segment from src to dst, addresses are host:port
+func (w *pcapWriter) packet(src, dst string, seq uint32, flags byte, payload string) {
+	srcHost, srcPort, _ := net.SplitHostPort(src)
+	dstHost, dstPort, _ := net.SplitHostPort(dst)
+	port := func(s string) uint16 {
+		p, _ := net.LookupPort("tcp", s)
+		return uint16(p)
+	}
+
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp, port(srcPort))
+	binary.BigEndian.PutUint16(tcp[2:], port(dstPort))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	tcp = append(tcp, payload...)
+
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], net.ParseIP(srcHost).To4())
+	copy(ip[16:], net.ParseIP(dstHost).To4())
+
+	frame := append(make([]byte, 12), 0x08, 0x00)
+	frame = append(append(frame, ip...), tcp...)
+
+	record := make([]byte, 16)
+	w.ts = w.ts.Add(time.Millisecond)
+	binary.LittleEndian.PutUint32(record, uint32(w.ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(w.ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+	w.Write(record)
+	w.Write(frame)
+}
+
+// conn writes a whole connection, every message of the client and server is
+// one segment
+func (w *pcapWriter) conn(client, server string, messages ...string) {
+	clientSeq, serverSeq := uint32(1000), uint32(5000)
+	w.packet(client, server, clientSeq, tcpSYN, "")
+	w.packet(server, client, serverSeq, tcpSYN|tcpACK, "")
+	clientSeq++
+	serverSeq++
+	for i, m := range messages {
+		if i%2 == 0 {
+			w.packet(client, server, clientSeq, tcpACK, m)
+			clientSeq += uint32(len(m))
+		} else {
+			w.packet(server, client, serverSeq, tcpACK, m)
+			serverSeq += uint32(len(m))
+		}
+	}
+	w.packet(client, server, clientSeq, tcpFIN|tcpACK, "")
+	w.packet(server, client, serverSeq, tcpFIN|tcpACK, "")
+}
+
+func TestReassembleTCP(t *testing.T) {
+	w := newPcapWriter()
+	client, server := "10.0.0.1:40000", "10.0.0.2:80"
+	w.packet(client, server, 99, tcpSYN, "")
+	w.packet(server, client, 499, tcpSYN|tcpACK, "")
+	w.packet(client, server, 100, tcpACK, "hello ")
+	// out of order, a retransmission and an overlap
+	w.packet(server, client, 506, tcpACK, "world")
+	w.packet(server, client, 500, tcpACK, "hello")
+	w.packet(server, client, 500, tcpACK, "hello")
+	w.packet(server, client, 503, tcpACK, "lo wo")
+	w.packet(client, server, 106, tcpACK, "again")
+	// the ports are reused, with a gap in the stream
+	w.packet(client, server, 9, tcpSYN, "")
+	w.packet(client, server, 10, tcpACK, "abc")
+	w.packet(client, server, 20, tcpACK, "xyz")
+
+	conns, err := reassembleTCP(&w.Buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 2 {
+		t.Fatalf("got %d connections, want 2", len(conns))
+	}
+	c := conns[0]
+	if c.client.String() != client || c.server.String() != server || !c.complete {
+		t.Errorf("connection %s -> %s, complete = %v", c.client, c.server, c.complete)
+	}
+	if string(c.clientToServer) != "hello again" || string(c.serverToClient) != "hello world" {
+		t.Errorf("streams %q and %q", c.clientToServer, c.serverToClient)
+	}
+	if c := conns[1]; c.complete || string(c.clientToServer) != "abc" {
+		t.Errorf("stream with a gap = %q, complete = %v", c.clientToServer, c.complete)
+	}
+}
+
+// a segment starting before the first byte, e.g. one that carries the SYN
+func TestAssembleBeforeBase(t *testing.T) {
+	h := &tcpHalf{base: 100, haveBase: true, segments: []tcpSegment{
+		{seq: 106, data: []byte("world")},
+		{seq: 98, data: []byte("..hello ")},
+	}}
+	stream, complete := h.assemble()
+	if string(stream) != "hello world" || !complete {
+		t.Errorf("stream = %q, complete = %v, want \"hello world\"", stream, complete)
+	}
+}
+
+func TestReadCorruptCapture(t *testing.T) {
+	// a packet record claiming 4 GiB after a valid packet
+	w := newPcapWriter()
+	w.packet("10.0.0.1:40000", "10.0.0.2:80", 1000, tcpSYN, "")
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[8:], 0xffffffff)
+	binary.LittleEndian.PutUint32(record[12:], 0xffffffff)
+	w.Write(record)
+
+	// a section header followed by a block claiming 4 GiB
+	ng := make([]byte, 28+8)
+	binary.LittleEndian.PutUint32(ng, 0x0a0d0d0a)
+	binary.LittleEndian.PutUint32(ng[4:], 28)
+	binary.LittleEndian.PutUint32(ng[8:], 0x1a2b3c4d)
+	binary.LittleEndian.PutUint32(ng[24:], 28)
+	binary.LittleEndian.PutUint32(ng[28:], 6)
+	binary.LittleEndian.PutUint32(ng[32:], 0xfffffffc)
+
+	tests := []struct {
+		name, capture string
+		packets       int
+		wantErr       string
+	}{
+		{"pcap", w.String(), 1, "invalid pcap packet length 4294967295"},
+		{"pcapng", string(ng), 0, "invalid pcapng block length 4294967292"},
+	}
+	for _, tt := range tests {
+		packets := 0
+		err := readCapture(strings.NewReader(tt.capture), func(ts time.Time, linkType uint32, data []byte) {
+			packets++
+		})
+		if err == nil || err.Error() != tt.wantErr {
+			t.Errorf("%s: readCapture = %v, want %q", tt.name, err, tt.wantErr)
+		}
+		if packets != tt.packets {
+			t.Errorf("%s: read %d packets, want %d", tt.name, packets, tt.packets)
+		}
+	}
+}
+
+func TestUploadPCAP(t *testing.T) {
+	g := newFakeGateway(t)
+	setupRun(t, g)
+
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write([]byte("MZ packed"))
+	zw.Close()
+
+	w := newPcapWriter()
+	w.conn("10.0.0.1:40000", "10.0.0.2:80",
+		"GET /files/evil.exe HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 7\r\n\r\nMZ evil",
+		"GET /download?id=1 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Disposition: attachment; filename=\"packed.exe\"\r\n"+
+			"Content-Length: "+strconv.Itoa(gzipped.Len())+"\r\n\r\n"+gzipped.String(),
+		"GET /404 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n",
+	)
+	mail := strings.Join([]string{
+		"From: alice@example.com",
+		"Subject: =?utf-8?q?Rechnung_f=C3=BCr_Mai?=",
+		"Content-Type: multipart/mixed; boundary=b",
+		"",
+		"--b",
+		"Content-Type: text/plain",
+		"",
+		"..see attached",
+		"--b",
+		"Content-Type: application/msword; name=invoice.doc",
+		"Content-Transfer-Encoding: base64",
+		"Content-Disposition: attachment",
+		"",
+		"0M8R4KGx",
+		"--b--",
+		"",
+	}, "\r\n")
+	w.conn("10.0.0.1:40001", "10.0.0.3:25",
+		"EHLO client\r\n", "220 hi\r\n",
+		"MAIL FROM:<alice@example.com> SIZE=100\r\nRCPT TO:<bob@example.com>\r\nDATA\r\n", "354 go\r\n",
+		mail+".\r\nQUIT\r\n", "250 ok\r\n",
+	)
+	w.conn("10.0.0.1:40002", "10.0.0.4:21",
+		"", "220 ftp\r\n",
+		"USER anonymous\r\nPASV\r\nRETR pub/tool.bin\r\n", "331 ok\r\n227 Entering Passive Mode (10,0,0,4,19,137).\r\n150 ok\r\n",
+	)
+	w.conn("10.0.0.1:40003", "10.0.0.4:5001", "", "\x7fELF tool")
+
+	options.PCAP = writeFile(t, "capture.pcap", w.String())
+	options.TagsStr = `["carved"]`
+	numWorkers = 1
+
+	codes := runUpload(t)
+
+	want := map[string]string{
+		"pcap:capture.pcap/1/http/1/evil.exe":    "MZ evil",
+		"pcap:capture.pcap/1/http/2/packed.exe":  "MZ packed",
+		"pcap:capture.pcap/2/smtp/1/invoice.doc": "\xd0\xcf\x11\xe0\xa1\xb1",
+		"pcap:capture.pcap/4/ftp/1/tool.bin":     "\x7fELF tool",
+	}
+	if len(g.Uploads()) != len(want) {
+		t.Fatalf("uploaded %v, log = %v", uploadedNames(g), codes)
+	}
+	if n := countMIMETypes(); n != len(want) {
+		t.Errorf("report has %d mime-types %v, want one per carved object", n, report.MIMETypes)
+	}
+	for sample := range want {
+		if codes[sample] != "200" {
+			t.Errorf("%s was logged as %q", sample, codes[sample])
+		}
+	}
+	for _, u := range g.Uploads() {
+		tags := strings.Join(u.Fields["tags"], " ")
+		switch u.Filename {
+		case "evil.exe":
+			if u.Fields.Get("comment") != "GET http://example.com/files/evil.exe" || !strings.Contains(tags, "host:example.com") {
+				t.Errorf("comment %q, tags %q", u.Fields.Get("comment"), tags)
+			}
+			if !strings.Contains(tags, "carved") || !strings.Contains(tags, "src-ip:10.0.0.1") || !strings.Contains(tags, "dst-port:80") {
+				t.Errorf("tags = %q, want the flow", tags)
+			}
+		case "invoice.doc":
+			if u.Fields.Get("comment") != "attachment of a mail from alice@example.com to bob@example.com: Rechnung für Mai" {
+				t.Errorf("comment = %q", u.Fields.Get("comment"))
+			}
+		case "tool.bin":
+			// the control connection describes the transfer
+			if !strings.Contains(tags, "protocol:ftp") || !strings.Contains(tags, "dst-port:21") {
+				t.Errorf("tags = %q", tags)
+			}
+		}
+		for sample, content := range want {
+			if strings.HasSuffix(sample, "/"+u.Filename) && string(u.Content) != content {
+				t.Errorf("%s = %q, want %q", u.Filename, u.Content, content)
+			}
+		}
+	}
+}
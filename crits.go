@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// critsClient talks to the CRITs API to resolve hashes to samples
+type critsClient struct {
+	BaseURI  string
+	Username string
+	APIKey   string
+}
+
+type critsName struct {
+	Name string `json:"name"`
+}
+
+// critsObject is a sample as returned by the CRITs API
+type critsObject struct {
+	Id         string      `json:"_id"`
+	Filename   string      `json:"filename"`
+	MD5        string      `json:"md5"`
+	SHA1       string      `json:"sha1"`
+	SHA256     string      `json:"sha256"`
+	Source     []critsName `json:"source"`
+	Campaign   []critsName `json:"campaign"`
+	BucketList []string    `json:"bucket_list"`
+}
+
+// critsField returns the CRITs field a hash or id of this length is matched
+// against
+func critsField(hash string) (string, error) {
+	for _, r := range hash {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return "", fmt.Errorf("%s is neither a hash nor a CRITs ID", hash)
+		}
+	}
+	switch len(hash) {
+	case 24:
+		return "_id", nil
+	case 32:
+		return "md5", nil
+	case 40:
+		return "sha1", nil
+	case 64:
+		return "sha256", nil
+	}
+	return "", fmt.Errorf("%s is neither a hash nor a CRITs ID", hash)
+}
+
+func (c *critsClient) get(path string, query url.Values) (*http.Response, error) {
+	query.Set("username", c.Username)
+	query.Set("api_key", c.APIKey)
+	req, err := http.NewRequestWithContext(rootCtx, "GET", strings.TrimRight(c.BaseURI, "/")+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		SafeResponseClose(resp)
+		return nil, fmt.Errorf("CRITs returned %s for %s", resp.Status, path)
+	}
+	return resp, nil
+}
+
+// Lookup resolves an MD5, SHA1 or SHA256-sum or a CRITs ID to the sample
+func (c *critsClient) Lookup(hash string) (*critsObject, error) {
+	field, err := critsField(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if field == "_id" {
+		resp, err := c.get("/api/v1/samples/"+hash+"/", url.Values{})
+		if err != nil {
+			return nil, err
+		}
+		defer SafeResponseClose(resp)
+		obj := &critsObject{}
+		return obj, json.NewDecoder(resp.Body).Decode(obj)
+	}
+
+	resp, err := c.get("/api/v1/samples/", url.Values{"c-" + field: {strings.ToLower(hash)}, "limit": {"1"}})
+	if err != nil {
+		return nil, err
+	}
+	defer SafeResponseClose(resp)
+	list := &struct {
+		Objects []critsObject `json:"objects"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(list)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Objects) == 0 {
+		return nil, errors.New("CRITs doesn't know " + hash)
+	}
+	return &list.Objects[0], nil
+}
+
+// Download returns the content of a sample. The CRITs file server is used, if
+// one is specified, otherwise the sample is taken from the API.
+func (c *critsClient) Download(obj *critsObject) (io.ReadCloser, error) {
+	if options.CritsFileServer != "" {
+		r, _, err := download(options.CritsFileServer+"/"+obj.Id, obj.Filename)
+		return r, err
+	}
+	resp, err := c.get("/api/v1/samples/"+obj.Id+"/", url.Values{"file": {"1"}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// metadata turns the CRITs source, campaigns and bucket list into upload
+// metadata. Campaigns are tagged as campaign:<name>.
+func (obj *critsObject) metadata() sampleMeta {
+	meta := sampleMeta{Name: obj.Filename}
+	for i, source := range obj.Source {
+		if i == 0 {
+			meta.Source = source.Name
+		}
+		meta.Tags = append(meta.Tags, "crits-source:"+source.Name)
+	}
+	for _, campaign := range obj.Campaign {
+		meta.Tags = append(meta.Tags, "campaign:"+campaign.Name)
+	}
+	meta.Tags = append(meta.Tags, obj.BucketList...)
+	return meta
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Toolbox/holmes"
+)
+
+// manifestEntry is a line of the manifest written by the download subcommand
+type manifestEntry struct {
+	Hash   string `json:"hash"` // as requested
+	File   string `json:"file,omitempty"`
+	Size   int    `json:"size,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+	SHA1   string `json:"sha1,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+const manifestName = "manifest.jsonl"
+
+func main_download(args []string) {
+	var (
+		hashFile, queryTags, querySource string
+		outDir, zipPassword              string
+		zipped                           bool
+		workers                          int
+	)
+
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	fs.StringVar(&options.GatewayURI, "gateway", "", "The URI of the master-gateway.")
+	fs.StringVar(&options.Username, "user", "", "Your username for authenticating to the master-gateway.")
+	fs.StringVar(&options.Password, "pw", "", "Your password for authenticating to the master-gateway. If this value is not set, you will be prompted for it.")
+	fs.BoolVar(&options.Insecure, "insecure", false, "If set, disables certificate checking")
+	fs.StringVar(&hashFile, "file", "", "File containing a list of hashes (MD5, SHA1 or SHA256) to download")
+	fs.StringVar(&queryTags, "tags", "", "Download all samples with these tags (as json list), instead of a list of hashes")
+	fs.StringVar(&querySource, "src", "", "Download all samples from this source, instead of a list of hashes")
+	fs.StringVar(&outDir, "out", "samples", "Directory to write the samples and the manifest to. If it contains a manifest, samples that were downloaded before are skipped")
+	fs.BoolVar(&zipped, "zip", false, "If set, every sample is written into its own password protected zip archive")
+	fs.StringVar(&zipPassword, "zip-pw", "infected", "Password for the zip archives")
+	fs.IntVar(&workers, "workers", 1, "Number of parallel workers")
+	timeoutFlags(fs)
+	fs.Parse(args)
+
+	if options.GatewayURI == "" {
+		warning.Fatal("Please specify the master-gateway with \"-gateway\"")
+	}
+	if options.Password == "" {
+		options.Password = readPassword("Please input your password for the master-gateway: ")
+	}
+	setupClient()
+
+	err := os.MkdirAll(outDir, 0755)
+	if err != nil {
+		warning.Fatal("Couldn't create output directory:", err)
+	}
+
+	// everything that is in the manifest with status ok, is skipped
+	done := map[string]struct{}{}
+	manifestPath := filepath.Join(outDir, manifestName)
+	if f, err := os.Open(manifestPath); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			e := manifestEntry{}
+			if json.Unmarshal(scanner.Bytes(), &e) == nil && e.Status == "ok" {
+				done[strings.ToLower(e.Hash)] = struct{}{}
+			}
+		}
+		f.Close()
+		info.Printf("Resuming, %d samples were downloaded before\n", len(done))
+	}
+	manifest, err := os.OpenFile(manifestPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		warning.Fatal("Couldn't open manifest:", err)
+	}
+	defer manifest.Close()
+
+	var hashes []string
+	if hashFile != "" {
+		hashes, err = readHashList(hashFile)
+	} else if queryTags != "" || querySource != "" {
+		hashes, err = querySamples(gateway, queryTags, querySource)
+	} else {
+		warning.Fatal("Please specify either \"-file\" or \"-tags\"/\"-src\"")
+	}
+	if err != nil {
+		warning.Fatal("Couldn't get the list of samples:", err)
+	}
+	info.Printf("Downloading %d samples...\n", len(hashes))
+
+	var dlWg sync.WaitGroup
+	hashC := make(chan string)
+	entryC := make(chan manifestEntry)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for hash := range hashC {
+				entryC <- downloadSample(hash, outDir, zipped, zipPassword)
+			}
+		}()
+	}
+	go func() {
+		for e := range entryC {
+			line, _ := json.Marshal(e)
+			if _, err := manifest.Write(append(line, '\n')); err != nil {
+				warning.Fatal(err)
+			}
+			if e.Status == "ok" {
+				info.Println("Downloaded", e.Hash, "to", e.File)
+			} else {
+				warning.Println("Downloading", e.Hash, "failed:", e.Error)
+			}
+			dlWg.Done()
+		}
+	}()
+
+	for _, hash := range hashes {
+		if cancelled() {
+			break
+		}
+		if _, ok := done[strings.ToLower(hash)]; ok {
+			debug.Printf("Skipping sample %s, because it was already downloaded\n", hash)
+			continue
+		}
+		dlWg.Add(1)
+		hashC <- hash
+	}
+	close(hashC)
+	dlWg.Wait()
+
+	info.Println("==================")
+	info.Println("Finished execution")
+}
+
+func readHashList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			hashes = append(hashes, fields[0])
+		}
+	}
+	return hashes, scanner.Err()
+}
+
+// querySamples asks the master-gateway for the SHA256-sums of all samples
+// matching the tags and source
+func querySamples(from *holmes.Client, tagsJSON, source string) ([]string, error) {
+	queryTags := []string{}
+	if tagsJSON != "" {
+		if err := json.Unmarshal([]byte(tagsJSON), &queryTags); err != nil {
+			return nil, err
+		}
+	}
+	return from.QuerySamples(rootCtx, queryTags, source)
+}
+
+// fetchStoredSample downloads the content of a sample from the master-gateway
+func fetchStoredSample(from *holmes.Client, hash string) ([]byte, error) {
+	r, err := from.GetSample(rootCtx, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func downloadSample(hash, outDir string, zipped bool, zipPassword string) manifestEntry {
+	e := manifestEntry{Hash: hash, Status: "failed"}
+
+	content, err := fetchStoredSample(gateway, hash)
+	if err != nil {
+		e.Error = err.Error()
+		return e
+	}
+
+	md5sum := md5.Sum(content)
+	sha1sum := sha1.Sum(content)
+	sha256sum := sha256.Sum256(content)
+	e.Size = len(content)
+	e.MD5 = hex.EncodeToString(md5sum[:])
+	e.SHA1 = hex.EncodeToString(sha1sum[:])
+	e.SHA256 = hex.EncodeToString(sha256sum[:])
+
+	h := strings.ToLower(hash)
+	if h != e.MD5 && h != e.SHA1 && h != e.SHA256 {
+		e.Error = "content doesn't match the hash"
+		return e
+	}
+
+	// write to a temporary file first, so a crash never leaves a partial sample
+	e.File = e.SHA256
+	if zipped {
+		e.File += ".zip"
+	}
+	path := filepath.Join(outDir, e.File)
+	tmp, err := os.Create(path + ".part")
+	if err != nil {
+		e.Error = err.Error()
+		return e
+	}
+	if zipped {
+		err = writeEncryptedZip(tmp, e.SHA256, content, zipPassword, time.Now())
+	} else {
+		_, err = tmp.Write(content)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".part", path)
+	}
+	if err != nil {
+		os.Remove(path + ".part")
+		e.Error = err.Error()
+		return e
+	}
+
+	e.Status = "ok"
+	return e
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// decryptZip reads the single file of an archive written by writeEncryptedZip
+func decryptZip(t *testing.T, archive []byte, password string) (string, []byte) {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 {
+		t.Fatalf("the archive contains %d files, want 1", len(zr.File))
+	}
+	f := zr.File[0]
+	if f.Flags&0x1 == 0 {
+		t.Fatalf("%s is not encrypted", f.Name)
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := ioutil.ReadAll(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := newZipKeys(password)
+	plain := make([]byte, len(encrypted))
+	for i, c := range encrypted {
+		k := keys[2] | 2
+		plain[i] = c ^ byte((k*(k^1))>>8)
+		keys.update(plain[i])
+	}
+	if plain[11] != byte(f.CRC32>>24) {
+		t.Fatalf("the password check of %s failed", f.Name)
+	}
+	content, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(plain[12:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crc32.ChecksumIEEE(content) != f.CRC32 || uint64(len(content)) != f.UncompressedSize64 {
+		t.Fatalf("%s doesn't match its CRC or size", f.Name)
+	}
+	return f.Name, content
+}
+
+func TestEncryptedZip(t *testing.T) {
+	content := bytes.Repeat([]byte("MZ\x90\x00 not really a binary "), 100)
+	modified := time.Date(2017, 3, 4, 5, 6, 8, 0, time.UTC)
+	buf := &bytes.Buffer{}
+	if err := writeEncryptedZip(buf, "sample.exe", content, "infected", modified); err != nil {
+		t.Fatal(err)
+	}
+
+	name, got := decryptZip(t, buf.Bytes(), "infected")
+	if name != "sample.exe" || !bytes.Equal(got, content) {
+		t.Errorf("got %s with %q, want sample.exe with the original content", name, got)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	g := newFakeGateway(t)
+	setupRun(t, g)
+	old, fresh := []byte("downloaded before"), []byte("new sample")
+	oldSum, freshSum := sha256sum(string(old)), sha256sum(string(fresh))
+	// the old sample is gone from the gateway, asking for it again would fail
+	g.samples[freshSum] = fresh
+
+	out := filepath.Join(t.TempDir(), "samples")
+	prev, _ := json.Marshal(manifestEntry{Hash: oldSum, File: oldSum + ".zip", SHA256: oldSum, Status: "ok"})
+	writeFile(t, filepath.Join(out, manifestName), string(prev)+"\n")
+	list := writeFile(t, "hashes", oldSum+"\n"+freshSum+"\n")
+
+	main_download([]string{"-gateway", g.URL, "-user", "test", "-pw", "test", "-file", list, "-out", out, "-zip", "-zip-pw", "secret"})
+
+	f, err := os.Open(filepath.Join(out, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries := []manifestEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := manifestEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 || entries[1].Hash != freshSum || entries[1].Status != "ok" {
+		t.Fatalf("manifest = %+v, want the old entry and the new sample", entries)
+	}
+
+	archive, err := ioutil.ReadFile(filepath.Join(out, entries[1].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, content := decryptZip(t, archive, "secret")
+	if name != freshSum || !bytes.Equal(content, fresh) {
+		t.Errorf("got %s with %q, want %s with %q", name, content, freshSum, fresh)
+	}
+}
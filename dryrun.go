@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// like "-workers", these are not restored from a log-file, so that a dry run
+// of a resumed upload never uploads anything
+var (
+	dryRun       bool
+	dryRunFormat string
+	dryRunHashes bool
+)
+
+// planEntry describes what would happen to a sample
+type planEntry struct {
+	Sample   string              `json:"sample"`
+	Included bool                `json:"included"`
+	Reason   string              `json:"reason,omitempty"`
+	MIME     string              `json:"mime,omitempty"`
+	Size     int64               `json:"size"`
+	MD5      string              `json:"md5,omitempty"`
+	SHA1     string              `json:"sha1,omitempty"`
+	SHA256   string              `json:"sha256,omitempty"`
+	Fields   map[string][]string `json:"fields,omitempty"`
+}
+
+type planTotal struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+var (
+	plan        *tabwriter.Writer
+	planByMIME  = map[string]*planTotal{}
+	planBySrc   = map[string]*planTotal{}
+	planSkipped int
+)
+
+func initDryRun() {
+	// keep stdout for the plan
+	info.SetOutput(os.Stderr)
+	debug.SetOutput(os.Stderr)
+
+	if dryRunFormat == "table" {
+		plan = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprint(plan, "ACTION\tMIME\tSIZE\tSAMPLE\tNAME\tSOURCE\tTAGS\tREASON")
+		if dryRunHashes {
+			fmt.Fprint(plan, "\tSHA256")
+		}
+		fmt.Fprintln(plan)
+	}
+}
+
+// includeSample hands a sample of the directory to the workers, or adds it to
+// the plan in a dry run
+func includeSample(in *input, path, mimetype string) {
+	if dryRun {
+		planSample(in, path, mimetype, "")
+		return
+	}
+	info.Println("Adding " + path + " (" + mimetype + ")")
+	wg.Add(1)
+	sched.push(in, path)
+}
+
+// excludeSample notes why a sample of the directory is not uploaded
+func excludeSample(in *input, path, mimetype, reason string) {
+	if dryRun {
+		planSample(in, path, mimetype, reason)
+		return
+	}
+	if mimetype != "" {
+		info.Println("Skipping " + path + " (" + mimetype + ")")
+	} else {
+		debug.Println("Skipping " + path + ": " + reason)
+	}
+}
+
+// planSample writes what would be uploaded for a sample, without fetching
+// anything that is not on the local disk
+func planSample(in *input, sample, mimetype, reason string) {
+	e := planEntry{Sample: sample, Included: reason == "", Reason: reason, MIME: mimetype}
+
+	local, streamed, scheme := true, false, ""
+	if u, err := url.Parse(sample); err == nil && u.Scheme != "" {
+		if _, ok := sampleSources[strings.ToLower(u.Scheme)]; ok {
+			scheme = strings.ToLower(u.Scheme)
+			local = scheme == "file"
+			if local {
+				sample = u.Path
+			}
+			_, streamed = sampleSources[scheme].(streamSource)
+		}
+	}
+	if local && scheme == "" && (options.CritsFileServer != "" || options.CritsURI != "") {
+		// like openSample, a line that is no local file is looked up in CRITs
+		if _, err := os.Stat(sample); os.IsNotExist(err) {
+			local, scheme = false, "CRITs"
+		}
+	}
+
+	var fromSource *sampleMeta
+	if e.Included && (local || streamed) {
+		var f io.ReadCloser
+		var err error
+		if streamed {
+			// already read from the stream, not fetched from anywhere
+			f, _, err = openSample(sample)
+			if m, ok := f.(metadataReader); ok {
+				sm := m.Metadata()
+				fromSource = &sm
+			}
+		} else {
+			f, err = os.Open(sample)
+		}
+		if err != nil {
+			e.Included = false
+			e.Reason = err.Error()
+		} else {
+			md5sum, sha1sum, sha256sum := md5.New(), sha1.New(), sha256.New()
+			var w io.Writer = ioutil.Discard
+			if dryRunHashes {
+				w = io.MultiWriter(md5sum, sha1sum, sha256sum)
+			}
+			e.Size, err = io.Copy(w, f)
+			f.Close()
+			if err != nil {
+				e.Included = false
+				e.Reason = err.Error()
+			} else if dryRunHashes {
+				e.MD5 = hex.EncodeToString(md5sum.Sum(nil))
+				e.SHA1 = hex.EncodeToString(sha1sum.Sum(nil))
+				e.SHA256 = hex.EncodeToString(sha256sum.Sum(nil))
+			}
+		}
+	} else if e.Included {
+		e.Reason = "would fetch from " + scheme
+	}
+
+	if e.Included {
+		meta, err := resolveMetadata(in, e.Sample, filepath.Base(sample), fromSource)
+		if err != nil {
+			e.Included = false
+			e.Reason = err.Error()
+		} else {
+			date := time.Now()
+			if !meta.Date.IsZero() {
+				date = meta.Date
+			}
+			e.Fields = map[string][]string{
+				"name":     {meta.Name},
+				"source":   {meta.Source},
+				"comment":  {meta.Comment},
+				"date":     {date.Format(time.RFC3339)},
+				"tags":     meta.Tags,
+				"username": {options.Username},
+			}
+			if meta.Path != "" {
+				e.Fields["path"] = []string{meta.Path}
+			}
+		}
+	}
+
+	if e.Included {
+		addPlanTotal(planByMIME, e.MIME, e.Size)
+		addPlanTotal(planBySrc, e.Fields["source"][0], e.Size)
+	} else {
+		planSkipped++
+	}
+
+	if plan != nil {
+		action := "upload"
+		if !e.Included {
+			action = "skip"
+		}
+		var name, source string
+		if e.Fields != nil {
+			name, source = e.Fields["name"][0], e.Fields["source"][0]
+		}
+		fmt.Fprintf(plan, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s", action, e.MIME, e.Size, e.Sample,
+			name, source, strings.Join(e.Fields["tags"], ","), e.Reason)
+		if dryRunHashes {
+			fmt.Fprint(plan, "\t"+e.SHA256)
+		}
+		fmt.Fprintln(plan)
+		return
+	}
+	line, _ := json.Marshal(e)
+	fmt.Println(string(line))
+}
+
+func addPlanTotal(totals map[string]*planTotal, key string, size int64) {
+	t, ok := totals[key]
+	if !ok {
+		t = &planTotal{}
+		totals[key] = t
+	}
+	t.Count++
+	t.Bytes += size
+}
+
+// finishDryRun prints the totals per MIME type and source
+func finishDryRun() {
+	if plan == nil {
+		line, _ := json.Marshal(map[string]interface{}{
+			"totals": map[string]interface{}{
+				"mime":    planByMIME,
+				"source":  planBySrc,
+				"skipped": planSkipped,
+			},
+		})
+		fmt.Println(string(line))
+		return
+	}
+	plan.Flush()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, group := range []struct {
+		title  string
+		totals map[string]*planTotal
+	}{{"MIME TYPE", planByMIME}, {"SOURCE", planBySrc}} {
+		keys := make([]string, 0, len(group.totals))
+		for key := range group.totals {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "%s\tSAMPLES\tBYTES\n", group.title)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", key, group.totals[key].Count, group.totals[key].Bytes)
+		}
+	}
+	fmt.Fprintf(w, "\nskipped\t%d\n", planSkipped)
+	w.Flush()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runDryRun plans an upload like main does with "-dry-run" and returns what
+// was written to stdout. The directory contains a sample, a hidden file, a
+// sidecar, a sample of the resumed log and a symlink, the list a remote sample
+// and a hash, that is looked up in CRITs.
+const critsHash = "0a4efbe854f1fa444303ca210842e779b55570216f62a4a406c89c564dabaf97"
+
+func runDryRun(t *testing.T, g *fakeGateway, format string) (string, string) {
+	dir := setupRun(t, g)
+	dryRun, dryRunFormat = true, format
+	root := filepath.Join(dir, "root")
+	sample := writeFile(t, filepath.Join(root, "a.exe"), "aaa")
+	writeFile(t, filepath.Join(root, ".hidden"), "hidden")
+	writeFile(t, sample+".meta.json", `{"tags": ["sidecar"]}`)
+	uploaded := writeFile(t, filepath.Join(root, "b.exe"), "bbb")
+	if err := os.Symlink(sample, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	remote := g.URL + "/samples/remote.exe"
+	options.Directory = pathList{root}
+	options.FPath = pathList{writeFile(t, "list", remote+"\n"+critsHash+"\n")}
+	options.CritsURI = g.URL + "/crits/api/v1/"
+	options.Source, options.Sidecars, options.SkipHidden, options.Symlinks = "feed", true, true, symlinksSkip
+
+	header, _ := json.Marshal(options)
+	resumeLog = writeFile(t, "resumed.log", string(header)+"\n"+uploaded+"\t200\n")
+	loadResumeLog()
+
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	saved := os.Stdout
+	os.Stdout = stdout
+	defer func() { os.Stdout = saved }()
+
+	setupClient()
+	main_upload()
+	out, err := ioutil.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), root
+}
+
+func TestDryRunJSONL(t *testing.T) {
+	g := newFakeGateway(t)
+	out, root := runDryRun(t, g, "jsonl")
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	entries := map[string]planEntry{}
+	for _, line := range lines[:len(lines)-1] {
+		e := planEntry{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries[strings.TrimPrefix(e.Sample, root+string(filepath.Separator))] = e
+	}
+
+	remote := g.URL + "/samples/remote.exe"
+	wantReasons := map[string]string{
+		"a.exe":           "",
+		".hidden":         "hidden",
+		"a.exe.meta.json": "metadata of another sample",
+		"b.exe":           "already uploaded",
+		"link":            "symlink",
+		remote:            "would fetch from http",
+		critsHash:         "would fetch from CRITs",
+	}
+	if len(entries) != len(wantReasons) {
+		t.Errorf("plan has %d samples, want %d:\n%s", len(entries), len(wantReasons), out)
+	}
+	for sample, reason := range wantReasons {
+		e, ok := entries[sample]
+		if !ok {
+			t.Errorf("%s is not in the plan", sample)
+			continue
+		}
+		if e.Reason != reason {
+			t.Errorf("%s: reason %q, want %q", sample, e.Reason, reason)
+		}
+		if included := sample == "a.exe" || sample == remote || sample == critsHash; e.Included != included {
+			t.Errorf("%s: included = %v, want %v", sample, e.Included, included)
+		}
+	}
+	if a := entries["a.exe"]; a.Size != 3 || a.Fields["source"][0] != "feed" || strings.Join(a.Fields["tags"], ",") != "sidecar" {
+		t.Errorf("a.exe is planned as %+v", a)
+	}
+
+	totals := struct {
+		Totals struct {
+			MIME    map[string]planTotal `json:"mime"`
+			Source  map[string]planTotal `json:"source"`
+			Skipped int                  `json:"skipped"`
+		} `json:"totals"`
+	}{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &totals); err != nil {
+		t.Fatal(err)
+	}
+	if got := totals.Totals; got.Skipped != 4 || got.Source["feed"] != (planTotal{Count: 3, Bytes: 3}) || got.MIME[entries["a.exe"].MIME].Bytes != 3 {
+		t.Errorf("totals = %+v", got)
+	}
+
+	if n := g.Requests(); n != 0 {
+		t.Errorf("the gateway got %d requests in a dry run", n)
+	}
+}
+
+func TestDryRunTable(t *testing.T) {
+	g := newFakeGateway(t)
+	out, root := runDryRun(t, g, "table")
+
+	rows := map[string][]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		for _, f := range fields {
+			if strings.HasPrefix(f, root) || strings.HasPrefix(f, g.URL) || f == critsHash {
+				rows[strings.TrimPrefix(f, root+string(filepath.Separator))] = fields
+			}
+		}
+	}
+	for sample, want := range map[string]string{"a.exe": "upload", "b.exe": "skip", ".hidden": "skip", critsHash: "upload"} {
+		if row := rows[sample]; len(row) == 0 || row[0] != want {
+			t.Errorf("%s: row %q, want the action %s", sample, row, want)
+		}
+	}
+	if row := rows["b.exe"]; !strings.HasSuffix(strings.Join(row, " "), "already uploaded") {
+		t.Errorf("b.exe: row %q, want the reason", row)
+	}
+	if !strings.Contains(out, "SOURCE") || !strings.Contains(strings.Join(strings.Fields(out), " "), "feed 3 3") {
+		t.Errorf("the totals by source are missing:\n%s", out)
+	}
+	if !strings.Contains(strings.Join(strings.Fields(out), " "), "skipped 4") {
+		t.Errorf("the number of skipped samples is missing:\n%s", out)
+	}
+
+	if n := g.Requests(); n != 0 {
+		t.Errorf("the gateway got %d requests in a dry run", n)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/net/html"
+	"golang.org/x/net/publicsuffix"
+)
+
+// indicator types found by the extract subcommand, in the order they are
+// listed. Hashes are tasked as files.
+var indicatorTypes = []string{"hash", objectIP, objectDomain, objectURL}
+
+var (
+	defangedSchemes = regexp.MustCompile(`(?i)\b(hxxp|hxtp|fxp)(s?)://`)
+	urlPattern      = regexp.MustCompile(`(?i)\b(?:https?|ftps?)://[^\s<>"'\x60(){}\[\]]+`)
+	hashPattern     = regexp.MustCompile(`(?i)\b(?:[0-9a-f]{64}|[0-9a-f]{40}|[0-9a-f]{32})\b`)
+	ipv4Pattern     = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Pattern     = regexp.MustCompile(`(?i)[0-9a-f]{0,4}(?::[0-9a-f]{0,4}){2,7}(?:(?:\d{1,3}\.){3}\d{1,3})?`)
+	domainPattern   = regexp.MustCompile(`(?i)\b(?:[\p{L}\p{N}](?:[\p{L}\p{N}-]{0,61}[\p{L}\p{N}])?\.)+\p{L}[\p{L}\p{N}-]{0,62}\b`)
+)
+
+// file extensions that are top-level domains as well. Names like invoice.zip
+// are only taken as domains, if they are defanged or the host of a URL.
+var fileExtensions = map[string]bool{
+	"zip": true, "mov": true, "one": true, "sh": true, "py": true, "ps": true, "md": true, "so": true,
+}
+
+// characters that are hidden in copied reports, and break indicators apart
+var invisibles = strings.NewReplacer("\u00ad", "", "\u200b", "", "\u200c", "", "\u200d", "", "\ufeff", "")
+
+// indicator is an object found in a report
+type indicator struct {
+	Type  string
+	Value string
+}
+
+func main_extract(args []string) {
+	var (
+		input, format, types, out       string
+		fileTasks, ipTasks, domainTasks string
+		urlTasks                        string
+		yes                             bool
+	)
+
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	fs.StringVar(&input, "in", "-", "Report to extract the indicators from, \"-\" for stdin. Text, HTML or the output of pdftotext")
+	fs.StringVar(&format, "format", "auto", "Format of the report: \"text\", \"html\" or \"auto\"")
+	fs.StringVar(&types, "types", "hash,ip,domain", "Comma separated list of the indicator types to extract: hash, ip, domain and url")
+	fs.StringVar(&out, "out", "", "Write the extracted indicators to this file, as a list for \"-tasking -object-type auto\" (optional)")
+	fs.BoolVar(&yes, "yes", false, "If set, the indicators are submitted without asking for confirmation")
+	fs.StringVar(&options.GatewayURI, "gateway", "", "The URI of the master-gateway. If empty, the indicators are only listed")
+	fs.StringVar(&options.Username, "user", "", "Your username for authenticating to the master-gateway.")
+	fs.StringVar(&options.Password, "pw", "", "Your password for authenticating to the master-gateway. If this value is not set, you will be prompted for it.")
+	fs.BoolVar(&options.Insecure, "insecure", false, "If set, disables certificate checking")
+	fs.StringVar(&options.TagsStr, "tags", "[]", "The tags for these tasks.")
+	fs.StringVar(&options.Comment, "comment", "", "Comment of submitter")
+	fs.StringVar(&options.Source, "src", "", "Source of the indicators, e.g. the report")
+	fs.StringVar(&fileTasks, "tasks", `{"PEINFO":[],"YARA":[]}`, "The tasks to execute for hashes")
+	fs.StringVar(&ipTasks, "ip-tasks", `{"ASNMETA":[]}`, "The tasks to execute for ip objects")
+	fs.StringVar(&domainTasks, "domain-tasks", `{"DNSMETA":[]}`, "The tasks to execute for domain objects")
+	fs.StringVar(&urlTasks, "url-tasks", "", "The tasks to execute for url objects, instead of those of \"-tasks\"")
+	timeoutFlags(fs)
+	fs.Parse(args)
+
+	wanted := map[string]bool{}
+	for _, t := range strings.Split(types, ",") {
+		t = strings.TrimSpace(t)
+		if !containsString(indicatorTypes, t) {
+			warning.Fatalf("Unknown indicator type %q", t)
+		}
+		wanted[t] = true
+	}
+	tasksByType, err := taskSets(fileTasks, ipTasks, domainTasks, urlTasks)
+	if err != nil {
+		warning.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(options.TagsStr), &tags); err != nil {
+		warning.Fatal("Error while parsing list of tags! ", err)
+	}
+
+	var r io.Reader = os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			warning.Fatal("Couldn't open report:", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	report, err := ioutil.ReadAll(r)
+	if err != nil {
+		warning.Fatal("Couldn't read report:", err)
+	}
+	if format == "html" || (format == "auto" && looksLikeHTML(report)) {
+		report = htmlText(report)
+	}
+
+	found := []indicator{}
+	for _, i := range extractIndicators(string(report)) {
+		if wanted[i.Type] {
+			found = append(found, i)
+		}
+	}
+	printIndicators(os.Stdout, found)
+	if out != "" {
+		if err := writeIndicators(out, found); err != nil {
+			warning.Fatal("Couldn't write the indicators:", err)
+		}
+		info.Println("Wrote the indicators to", out)
+	}
+
+	if len(found) == 0 || options.GatewayURI == "" {
+		return
+	}
+	if !yes && !confirm(fmt.Sprintf("Submit %d indicators to %s? [y/N] ", len(found), options.GatewayURI)) {
+		info.Println("Nothing was submitted")
+		return
+	}
+
+	if options.Password == "" {
+		options.Password = readTTYPassword("Please input your password for the master-gateway: ")
+	}
+	setupClient()
+	allTasks := make([]Task, 0, len(found))
+	for _, i := range found {
+		objectType, filename := i.Type, ""
+		if objectType == "hash" {
+			objectType, filename = objectFile, i.Value
+		}
+		allTasks = append(allTasks, newTask(objectType, i.Value, filename, options.Source, tasksByType[objectType]))
+	}
+	if err := submitTasks(allTasks); err != nil {
+		warning.Println("The server returned the following errors:")
+		warning.Fatal(err)
+	}
+	info.Printf("Submitted %d tasks\n", len(allTasks))
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func looksLikeHTML(report []byte) bool {
+	start := bytes.ToLower(bytes.TrimSpace(report))
+	if len(start) > 512 {
+		start = start[:512]
+	}
+	return bytes.HasPrefix(start, []byte("<!doctype html")) || bytes.Contains(start, []byte("<html")) || bytes.Contains(start, []byte("<body"))
+}
+
+// htmlText returns the text of an HTML document, and the targets of its
+// links, which often hold indicators that are not in the text
+func htmlText(report []byte) []byte {
+	var buf bytes.Buffer
+	z := html.NewTokenizer(bytes.NewReader(report))
+	skip := 0 // inside of script or style
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return buf.Bytes()
+		case html.TextToken:
+			if skip == 0 {
+				buf.Write(z.Text())
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) == "script" || string(name) == "style" {
+				skip++
+			}
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				if string(key) == "href" || string(key) == "src" {
+					buf.WriteString(" " + string(val) + " ")
+				}
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		}
+		// tags separate words
+		buf.WriteByte(' ')
+	}
+}
+
+// extractIndicators returns the hashes, IPs, domains and URLs of a text in the
+// order of their first occurrence, after refanging it
+func extractIndicators(text string) []indicator {
+	text = invisibles.Replace(text)
+	defanged := map[string]bool{}
+	for _, field := range strings.Fields(text) {
+		if refanged := refanger.Replace(field); refanged != field {
+			for _, m := range domainPattern.FindAllString(refanged, -1) {
+				if v, err := normalizeDomain(m); err == nil {
+					defanged[v] = true
+				}
+			}
+		}
+	}
+	text = refanger.Replace(text)
+	text = defangedSchemes.ReplaceAllStringFunc(text, refang)
+
+	var found []indicator
+	seen := map[indicator]bool{}
+	add := func(t, v string) {
+		i := indicator{t, v}
+		if !seen[i] {
+			seen[i] = true
+			found = append(found, i)
+		}
+	}
+
+	hosts := map[string]bool{} // of the URLs
+	for _, m := range urlPattern.FindAllString(text, -1) {
+		if v, err := normalizeURL(strings.TrimRight(m, ".,;:!?")); err == nil {
+			add(objectURL, v)
+			if u, err := url.Parse(v); err == nil {
+				hosts[u.Hostname()] = true
+			}
+		}
+	}
+	for _, m := range hashPattern.FindAllString(text, -1) {
+		add("hash", strings.ToLower(m))
+	}
+	for _, m := range ipv4Pattern.FindAllString(text, -1) {
+		if v, err := normalizeIP(m); err == nil {
+			add(objectIP, v)
+		}
+	}
+	for _, m := range ipv6Pattern.FindAllString(text, -1) {
+		// at least two groups, code like std::string is no address
+		groups := strings.FieldsFunc(m, func(r rune) bool { return r == ':' })
+		ip := net.ParseIP(m)
+		if ip != nil && ip.To4() == nil && len(groups) >= 2 && !ip.IsLoopback() {
+			add(objectIP, ip.String())
+		}
+	}
+	for _, m := range domainPattern.FindAllString(text, -1) {
+		v, err := normalizeDomain(m)
+		if err != nil {
+			continue
+		}
+		// filenames like invoice.exe look like domains, but have no known suffix
+		if _, icann := publicsuffix.PublicSuffix(v); !icann {
+			continue
+		}
+		if fileExtensions[v[strings.LastIndex(v, ".")+1:]] && !defanged[v] && !hosts[v] {
+			continue
+		}
+		add(objectDomain, v)
+	}
+
+	// grouped by type, in the order of the text within each type
+	sorted := make([]indicator, 0, len(found))
+	for _, t := range indicatorTypes {
+		for _, i := range found {
+			if i.Type == t {
+				sorted = append(sorted, i)
+			}
+		}
+	}
+	return sorted
+}
+
+// printIndicators lists the indicators for review, grouped by type
+func printIndicators(w io.Writer, found []indicator) {
+	if len(found) == 0 {
+		fmt.Fprintln(w, "No indicators found")
+		return
+	}
+	for n, i := range found {
+		if n == 0 || found[n-1].Type != i.Type {
+			count := 0
+			for _, j := range found {
+				if j.Type == i.Type {
+					count++
+				}
+			}
+			fmt.Fprintf(w, "%s (%d)\n", i.Type, count)
+		}
+		fmt.Fprintln(w, "  "+i.Value)
+	}
+}
+
+// writeIndicators writes a list that can be tasked with -object-type auto
+func writeIndicators(path string, found []indicator) error {
+	var buf bytes.Buffer
+	for _, i := range found {
+		line := i.Value
+		if i.Type == "hash" {
+			// <hash> <filename> <source>
+			line += " " + i.Value
+		}
+		if options.Source != "" {
+			line += " " + options.Source
+		}
+		buf.WriteString(line + "\n")
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// ttyPath is the terminal the questions of extract are asked on, as the
+// report might be read from stdin
+var ttyPath = "/dev/tty"
+
+// confirm asks a yes/no question on the terminal
+func confirm(prompt string) bool {
+	tty, err := os.Open(ttyPath)
+	if err != nil {
+		warning.Fatal("Couldn't ask for confirmation, use \"-yes\" to submit without it:", err)
+	}
+	defer tty.Close()
+	fmt.Fprint(os.Stderr, prompt)
+	answer, _ := bufio.NewReader(tty).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// readTTYPassword prompts for a password on the terminal, like readPassword
+// does on stdin
+func readTTYPassword(prompt string) string {
+	tty, err := os.Open(ttyPath)
+	if err != nil {
+		warning.Fatal("Couldn't ask for the password, use \"-pw\" to give it:", err)
+	}
+	defer tty.Close()
+	fmt.Fprintln(os.Stderr, prompt)
+	if terminal.IsTerminal(int(tty.Fd())) {
+		pw, err := terminal.ReadPassword(int(tty.Fd()))
+		if err != nil {
+			warning.Fatal("Error reading password from terminal:", err)
+		}
+		return string(pw)
+	}
+	pw, _ := bufio.NewReader(tty).ReadString('\n')
+	return strings.TrimRight(pw, "\r\n")
+}
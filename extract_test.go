@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractIndicators(t *testing.T) {
+	report := `The dropper (SHA256 0A4EFBE854F1FA444303CA210842E779B55570216F62A4A406C89C564DABAF97,
+MD5 d41d8cd98f00b204e9800998ecf8427e) connects to 185[.]220[.]101[.]4 and 2001:db8:0:0::17,
+then downloads hxxps://cdn.evil-update[.]com/payload.bin; see also evil-update(dot)com.
+It writes invoice.exe and calls std::string, at 12:30:45. Again: 185.220.101.4, bücher.de`
+	got := extractIndicators(report)
+	want := []indicator{
+		{"hash", "0a4efbe854f1fa444303ca210842e779b55570216f62a4a406c89c564dabaf97"},
+		{"hash", "d41d8cd98f00b204e9800998ecf8427e"},
+		{"ip", "185.220.101.4"},
+		{"ip", "2001:db8::17"},
+		{"domain", "cdn.evil-update.com"},
+		{"domain", "evil-update.com"},
+		{"domain", "xn--bcher-kva.de"},
+		{"url", "https://cdn.evil-update.com/payload.bin"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("indicators = %v, want %v", got, want)
+	}
+}
+
+// attachments look like domains of TLDs such as .zip, unless they are defanged
+func TestExtractAttachmentNames(t *testing.T) {
+	report := `The mail came with invoice.zip and clip.mov, which drop setup.sh and notes.one.
+The payload is hosted on update-check[.]zip and http://cdn.files.mov/a.exe, not on invoice.zip.`
+	got := extractIndicators(report)
+	want := []indicator{
+		{"domain", "update-check.zip"},
+		{"domain", "cdn.files.mov"},
+		{"url", "http://cdn.files.mov/a.exe"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("indicators = %v, want %v", got, want)
+	}
+}
+
+func TestHTMLText(t *testing.T) {
+	page := `<html><head><style>a.evil.com{}</style><script>var x = "1.2.3.4"</script></head>
+<body><p>C2: <a href="hxxp://c2.example.org/gate.php">the panel</a>&nbsp;at 10.0.0.1</p></body></html>`
+	if !looksLikeHTML([]byte(page)) {
+		t.Fatal("the page was not recognized as HTML")
+	}
+	got := extractIndicators(string(htmlText([]byte(page))))
+	want := []indicator{
+		{"ip", "10.0.0.1"},
+		{"domain", "c2.example.org"},
+		{"url", "http://c2.example.org/gate.php"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("indicators = %v, want %v", got, want)
+	}
+}
+
+func TestExtractSubmit(t *testing.T) {
+	g := newFakeGateway(t)
+	dir := setupRun(t, g)
+	report := writeFile(t, filepath.Join(dir, "report.txt"), "hash d41d8cd98f00b204e9800998ecf8427e from evil[.]com and 8.8.8.8")
+	list := filepath.Join(dir, "list")
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	main_extract([]string{"-in", report, "-out", list, "-gateway", g.URL, "-user", "test", "-pw", "test",
+		"-src", "report-42", "-tags", `["apt"]`, "-yes"})
+	w.Close()
+	os.Stdout = stdout
+	var printed bytes.Buffer
+	printed.ReadFrom(r)
+
+	wantPrinted := "hash (1)\n  d41d8cd98f00b204e9800998ecf8427e\nip (1)\n  8.8.8.8\ndomain (1)\n  evil.com\n"
+	if printed.String() != wantPrinted {
+		t.Errorf("printed %q, want %q", printed.String(), wantPrinted)
+	}
+	written, _ := ioutil.ReadFile(list)
+	if want := "d41d8cd98f00b204e9800998ecf8427e d41d8cd98f00b204e9800998ecf8427e report-42\n8.8.8.8 report-42\nevil.com report-42\n"; string(written) != want {
+		t.Errorf("list = %q, want %q", written, want)
+	}
+
+	tasks := g.Tasks()
+	if len(tasks) != 3 {
+		t.Fatalf("gateway got %d tasks, want 3", len(tasks))
+	}
+	for _, task := range tasks {
+		download := !strings.Contains(task.PrimaryURI, ".")
+		if task.Download != download || task.Source != "report-42" || !reflect.DeepEqual(task.Tags, []string{"apt"}) {
+			t.Errorf("task = %+v", task)
+		}
+	}
+	if _, ok := tasks[1].Tasks["ASNMETA"]; !ok {
+		t.Errorf("ip task = %+v, want the ip tasks", tasks[1])
+	}
+	if _, ok := tasks[2].Tasks["DNSMETA"]; !ok {
+		t.Errorf("domain task = %+v, want the domain tasks", tasks[2])
+	}
+}
+
+// the report is piped in, so the password is asked for on the terminal
+func TestExtractStdinPassword(t *testing.T) {
+	g := newFakeGateway(t)
+	dir := setupRun(t, g)
+	savedTTY := ttyPath
+	ttyPath = writeFile(t, filepath.Join(dir, "tty"), "test\n")
+	defer func() { ttyPath = savedTTY }()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString("C2 at 8.8.8.8")
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	main_extract([]string{"-gateway", g.URL, "-user", "test", "-yes"})
+
+	if options.Password != "test" {
+		t.Errorf("password = %q, want the one of the terminal", options.Password)
+	}
+	if tasks := g.Tasks(); len(tasks) != 1 || tasks[0].PrimaryURI != "8.8.8.8" {
+		t.Errorf("gateway got %+v, want the task of 8.8.8.8", tasks)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUpload is a sample the fake gateway received
+type fakeUpload struct {
+	Fields   url.Values // all multipart fields except for the sample
+	Filename string
+	Content  []byte
+}
+
+// fakeResponse is what the fake gateway answers to a request
+type fakeResponse struct {
+	Status  int
+	Body    string
+	Latency time.Duration // the request is answered after this time
+}
+
+// fakeGateway is an in-process master-gateway. Uploads and tasks are recorded
+// and answered with 200, unless a response is scripted for them.
+type fakeGateway struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests int // of all kinds
+	uploads  []fakeUpload
+	tasks    []Task
+	batches  []int                     // number of tasks per tasking request
+	samples  map[string][]byte         // accepted samples by SHA256-sum
+	submits  map[string][]submission   // answers of the submissions endpoint by SHA256-sum
+	scripts  map[string][]fakeResponse // next responses by endpoint, "samples" or "task"
+	byName   map[string]fakeResponse   // responses to every upload of a name
+}
+
+func newFakeGateway(t *testing.T) *fakeGateway {
+	g := &fakeGateway{
+		samples: map[string][]byte{},
+		submits: map[string][]submission{},
+		scripts: map[string][]fakeResponse{},
+		byName:  map[string]fakeResponse{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/samples/", g.handleSamples)
+	mux.HandleFunc("/task/", g.handleTask)
+	mux.HandleFunc("/submissions/", g.handleSubmissions)
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.mu.Lock()
+		g.requests++
+		g.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(g.Close)
+	return g
+}
+
+// script queues responses for the next requests to an endpoint
+func (g *fakeGateway) script(endpoint string, responses ...fakeResponse) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.scripts[endpoint] = append(g.scripts[endpoint], responses...)
+}
+
+// scriptSample sets the response to every upload with the name
+func (g *fakeGateway) scriptSample(name string, r fakeResponse) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.byName[name] = r
+}
+
+func (g *fakeGateway) Uploads() []fakeUpload {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]fakeUpload(nil), g.uploads...)
+}
+
+// upload returns the last upload with the name
+func (g *fakeGateway) upload(name string) (fakeUpload, bool) {
+	uploads := g.Uploads()
+	for i := len(uploads) - 1; i >= 0; i-- {
+		if uploads[i].Fields.Get("name") == name {
+			return uploads[i], true
+		}
+	}
+	return fakeUpload{}, false
+}
+
+func (g *fakeGateway) Requests() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests
+}
+
+func (g *fakeGateway) Tasks() []Task {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]Task(nil), g.tasks...)
+}
+
+func (g *fakeGateway) Batches() []int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]int(nil), g.batches...)
+}
+
+// respond picks the scripted response, name is only set for uploads
+func (g *fakeGateway) respond(endpoint, name string) fakeResponse {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if r, ok := g.byName[name]; ok && name != "" {
+		return r
+	}
+	if queue := g.scripts[endpoint]; len(queue) > 0 {
+		g.scripts[endpoint] = queue[1:]
+		return queue[0]
+	}
+	return fakeResponse{Status: 200}
+}
+
+func (g *fakeGateway) write(w http.ResponseWriter, r *http.Request, resp fakeResponse) {
+	if resp.Latency > 0 {
+		select {
+		case <-time.After(resp.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if resp.Status == 0 {
+		resp.Status = 200
+	}
+	w.WriteHeader(resp.Status)
+	w.Write([]byte(resp.Body))
+}
+
+func authorized(values url.Values) bool {
+	return values.Get("username") == "test" && values.Get("password") == "test"
+}
+
+// basicAuthorized checks the credentials of requests without a form, they
+// must not be part of the URL
+func basicAuthorized(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	return ok && username == "test" && password == "test" && r.URL.Query().Get("password") == ""
+}
+
+func (g *fakeGateway) handleSamples(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		hash := strings.TrimPrefix(r.URL.Path, "/samples/")
+		g.mu.Lock()
+		content, ok := g.samples[hash]
+		g.mu.Unlock()
+		if !basicAuthorized(r) {
+			w.WriteHeader(401)
+			return
+		}
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(content)
+		return
+	}
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !authorized(r.MultipartForm.Value) {
+		w.WriteHeader(401)
+		return
+	}
+	file, header, err := r.FormFile("sample")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	content, _ := ioutil.ReadAll(file)
+	file.Close()
+
+	upload := fakeUpload{Fields: url.Values(r.MultipartForm.Value), Filename: header.Filename, Content: content}
+	g.mu.Lock()
+	g.uploads = append(g.uploads, upload)
+	g.mu.Unlock()
+
+	resp := g.respond("samples", upload.Fields.Get("name"))
+	if resp.Status == 0 || resp.Status == 200 {
+		sum := sha256.Sum256(content)
+		g.mu.Lock()
+		g.samples[hex.EncodeToString(sum[:])] = content
+		g.mu.Unlock()
+	}
+	g.write(w, r, resp)
+}
+
+func (g *fakeGateway) handleTask(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !authorized(r.PostForm) {
+		w.WriteHeader(401)
+		return
+	}
+	tasks := []Task{}
+	err = json.Unmarshal([]byte(r.PostForm.Get("task")), &tasks)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	g.mu.Lock()
+	g.tasks = append(g.tasks, tasks...)
+	g.batches = append(g.batches, len(tasks))
+	g.mu.Unlock()
+	g.write(w, r, g.respond("task", ""))
+}
+
+func (g *fakeGateway) handleSubmissions(w http.ResponseWriter, r *http.Request) {
+	if !basicAuthorized(r) {
+		w.WriteHeader(401)
+		return
+	}
+	g.mu.Lock()
+	submissions := g.submits[r.URL.Query().Get("sha256")]
+	g.mu.Unlock()
+	json.NewEncoder(w).Encode(submissions)
+}
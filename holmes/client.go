@@ -0,0 +1,338 @@
+// Package holmes is a client for the Holmes-Gateway. It uploads samples to
+// Holmes-Storage, tasks Holmes-Totem and downloads stored samples.
+//
+//	c, err := holmes.NewClient(holmes.Config{
+//		GatewayURI: "https://127.0.0.1:8090",
+//		Username:   "test",
+//		Password:   "test",
+//	})
+//	result, err := c.UploadSample(ctx, f, holmes.Metadata{Name: "sample.exe", Source: "src"})
+//
+// Uploads and tasks send the credentials as form fields, all other requests
+// use basic auth.
+package holmes
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Config describes a gateway and how to authenticate to it.
+type Config struct {
+	GatewayURI string // e.g. https://127.0.0.1:8090
+	Username   string
+	Password   string
+
+	// Insecure disables certificate checking, it is ignored if TLSConfig or
+	// HTTPClient is set.
+	Insecure  bool
+	TLSConfig *tls.Config
+
+	// Timeouts of the default client, zero means no timeout. Timeout limits
+	// a whole request including reading the response.
+	ConnectTimeout        time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	Timeout               time.Duration
+
+	// HTTPClient is used for all requests if set, e.g. to share a transport.
+	// The timeouts above are ignored then.
+	HTTPClient *http.Client
+}
+
+// Client talks to a single gateway. It is safe for concurrent use.
+type Client struct {
+	cfg  Config
+	http *http.Client
+}
+
+// Task is a tasking request for Holmes-Totem, as expected by the gateway.
+type Task struct {
+	PrimaryURI   string              `json:"primaryURI"`
+	SecondaryURI string              `json:"secondaryURI"`
+	Filename     string              `json:"filename"`
+	Tasks        map[string][]string `json:"tasks"`
+	Tags         []string            `json:"tags"`
+	Attempts     int                 `json:"attempts"`
+	Source       string              `json:"source"`
+	Download     bool                `json:"download"`
+	Comment      string              `json:"comment"`
+}
+
+// Metadata is sent together with an uploaded sample.
+type Metadata struct {
+	Name    string // the filename
+	Source  string
+	Comment string
+	Tags    []string
+	Date    time.Time // the upload date if zero
+	Path    string    // relative path of the sample, only sent if set
+}
+
+// UploadResult describes an accepted upload.
+type UploadResult struct {
+	SHA256     string
+	Size       int64
+	StatusCode int
+	Body       string
+}
+
+// NewClient returns a client for the gateway given by cfg.
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.GatewayURI == "" {
+		return nil, ErrNoGateway
+	}
+	cfg.GatewayURI = strings.TrimRight(cfg.GatewayURI, "/")
+
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		tlsConfig := cfg.TLSConfig
+		if tlsConfig == nil && cfg.Insecure {
+			tlsConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+				TLSClientConfig:       tlsConfig,
+				TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+				ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+			},
+			Timeout: cfg.Timeout,
+		}
+	}
+	return &Client{cfg: cfg, http: httpClient}, nil
+}
+
+// Config returns the configuration of the client.
+func (c *Client) Config() Config {
+	return c.cfg
+}
+
+// Credentials returns the form fields the gateway authenticates uploads and
+// tasks with.
+func (c *Client) Credentials() url.Values {
+	query := url.Values{}
+	query.Set("username", c.cfg.Username)
+	query.Set("password", c.cfg.Password)
+	return query
+}
+
+// Get sends an authenticated GET request to uri, which doesn't have to be on
+// the gateway. The caller has to close the body of the response.
+func (c *Client) Get(ctx context.Context, uri string) (*http.Response, error) {
+	return c.do(ctx, "GET", uri)
+}
+
+// do sends a request without a body. The credentials are sent with basic
+// auth, so that the password never shows up in a URL or an access log.
+func (c *Client) do(ctx context.Context, method, uri string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, &NetworkError{Op: strings.ToLower(method), Err: err}
+	}
+	return resp, nil
+}
+
+// UploadSample sends the content of r to Holmes-Storage. The sample is read
+// completely before anything is sent, cancelling ctx aborts the upload. If
+// the gateway didn't accept the sample, an *HTTPError is returned together
+// with the result.
+func (c *Client) UploadSample(ctx context.Context, r io.Reader, meta Metadata) (*UploadResult, error) {
+	date := meta.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	params := c.Credentials()
+	//"user_id": user id of uploader; is filled in by Gateway based on the specified username
+	params.Set("name", meta.Name)
+	params.Set("source", meta.Source)
+	params.Set("comment", meta.Comment)
+	params.Set("date", date.Format(time.RFC3339))
+	params["tags"] = meta.Tags
+	if meta.Path != "" {
+		params.Set("path", meta.Path)
+	}
+
+	// build Holmes-Storage PUT request
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("sample", meta.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(part, h), r)
+	if err != nil {
+		return nil, &ReadError{Err: err}
+	}
+	result := &UploadResult{SHA256: hex.EncodeToString(h.Sum(nil)), Size: size}
+
+	for key, valMul := range params {
+		for _, val := range valMul {
+			err = writer.WriteField(key, val)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.cfg.GatewayURI+"/samples/", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return result, &NetworkError{Op: "upload", Err: err}
+	}
+	defer closeResponse(resp)
+	result.StatusCode = resp.StatusCode
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	result.Body = string(respBody)
+	if err != nil {
+		return result, &NetworkError{Op: "upload", Err: err}
+	}
+	if resp.StatusCode != 200 {
+		return result, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: result.Body}
+	}
+	return result, nil
+}
+
+// SubmitTasks sends a list of tasks to the gateway, which hands them to
+// Holmes-Totem.
+func (c *Client) SubmitTasks(ctx context.Context, tasks []Task) error {
+	jsoned, err := json.Marshal(tasks)
+	if err != nil {
+		return err
+	}
+
+	data := c.Credentials()
+	data.Set("task", string(jsoned))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.cfg.GatewayURI+"/task/", strings.NewReader(data.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return &NetworkError{Op: "task", Err: err}
+	}
+	defer closeResponse(resp)
+
+	tskerrors, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &NetworkError{Op: "task", Err: err}
+	}
+	if resp.StatusCode != 200 {
+		return &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(tskerrors)}
+	}
+	if len(tskerrors) != 0 {
+		return &TaskError{Message: string(tskerrors)}
+	}
+	return nil
+}
+
+// GetSample downloads a stored sample by its MD5, SHA1 or SHA256-sum. The
+// caller has to close the returned reader.
+func (c *Client) GetSample(ctx context.Context, hash string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, "GET", c.sampleURI(hash))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, responseError(resp)
+	}
+	return resp.Body, nil
+}
+
+// HasSample reports whether the gateway has a sample.
+func (c *Client) HasSample(ctx context.Context, hash string) (bool, error) {
+	resp, err := c.do(ctx, "HEAD", c.sampleURI(hash))
+	if err != nil {
+		return false, err
+	}
+	closeResponse(resp)
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+// QuerySamples returns the SHA256-sums of all samples having all of the tags
+// and the source, both are optional.
+func (c *Client) QuerySamples(ctx context.Context, tags []string, source string) ([]string, error) {
+	query := url.Values{}
+	if len(tags) != 0 {
+		query["tags"] = tags
+	}
+	if source != "" {
+		query.Set("source", source)
+	}
+
+	resp, err := c.do(ctx, "GET", c.cfg.GatewayURI+"/samples/?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, responseError(resp)
+	}
+	defer closeResponse(resp)
+
+	objects := []struct {
+		SHA256 string `json:"sha256"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&objects); err != nil {
+		return nil, &NetworkError{Op: "query", Err: err}
+	}
+	hashes := make([]string, 0, len(objects))
+	for _, o := range objects {
+		hashes = append(hashes, o.SHA256)
+	}
+	return hashes, nil
+}
+
+func (c *Client) sampleURI(hash string) string {
+	return c.cfg.GatewayURI + "/samples/" + url.PathEscape(hash)
+}
+
+// responseError reads and closes the response of a failed request
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	closeResponse(resp)
+	return &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(body)}
+}
+
+// closeResponse drains the body, so the connection can be reused
+func closeResponse(r *http.Response) {
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+}
@@ -0,0 +1,194 @@
+package holmes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	c, err := NewClient(Config{GatewayURI: srv.URL + "/", Username: "user", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestNewClient(t *testing.T) {
+	if _, err := NewClient(Config{}); err != ErrNoGateway {
+		t.Errorf("NewClient without a gateway = %v, want ErrNoGateway", err)
+	}
+}
+
+func TestUploadSample(t *testing.T) {
+	var got *http.Request
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+		}
+		got = r
+		if r.FormValue("name") == "bad.exe" {
+			http.Error(w, "no sample", 500)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	date := time.Date(2016, 9, 25, 0, 0, 0, 0, time.UTC)
+	result, err := c.UploadSample(context.Background(), strings.NewReader("MZ"), Metadata{
+		Name: "a.exe", Source: "src", Comment: "c", Tags: []string{"x", "y"}, Date: date, Path: "dir/a.exe",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("MZ"))
+	if result.SHA256 != hex.EncodeToString(sum[:]) || result.Size != 2 || result.StatusCode != 200 || result.Body != "ok" {
+		t.Errorf("result = %+v", result)
+	}
+	if got.Method != "POST" || got.URL.Path != "/samples/" || got.URL.RawQuery != "" {
+		t.Errorf("uploaded with %s %s", got.Method, got.URL)
+	}
+	want := map[string][]string{
+		"username": {"user"}, "password": {"secret"}, "name": {"a.exe"}, "source": {"src"},
+		"comment": {"c"}, "date": {"2016-09-25T00:00:00Z"}, "tags": {"x", "y"}, "path": {"dir/a.exe"},
+	}
+	if !reflect.DeepEqual(map[string][]string(got.MultipartForm.Value), want) {
+		t.Errorf("fields = %v, want %v", got.MultipartForm.Value, want)
+	}
+	f, header, err := got.FormFile("sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(f)
+	if header.Filename != "a.exe" || string(content) != "MZ" {
+		t.Errorf("sample %s with %q", header.Filename, content)
+	}
+
+	result, err = c.UploadSample(context.Background(), strings.NewReader("MZ"), Metadata{Name: "bad.exe"})
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != 500 || httpErr.Body != "no sample\n" || result.StatusCode != 500 {
+		t.Errorf("upload of bad.exe = %+v, %v, want an HTTPError", result, err)
+	}
+
+	_, err = c.UploadSample(context.Background(), failingReader{}, Metadata{Name: "unreadable.exe"})
+	var readErr *ReadError
+	if !errors.As(err, &readErr) {
+		t.Errorf("upload of an unreadable sample = %v, want a ReadError", err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("disk on fire") }
+
+func TestSubmitTasks(t *testing.T) {
+	answer, status := "", 200
+	var got []Task
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/task/" || r.PostForm.Get("username") != "user" || r.PostForm.Get("password") != "secret" {
+			t.Errorf("tasked with %s and %v", r.URL, r.PostForm)
+		}
+		json.Unmarshal([]byte(r.PostForm.Get("task")), &got)
+		w.WriteHeader(status)
+		w.Write([]byte(answer))
+	})
+
+	tasks := []Task{{PrimaryURI: "aaaa", Tasks: map[string][]string{"PEINFO": {}}, Tags: []string{"t"}}}
+	if err := c.SubmitTasks(context.Background(), tasks); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, tasks) {
+		t.Errorf("gateway got %+v, want %+v", got, tasks)
+	}
+
+	answer = "PEINFO: unknown service"
+	var taskErr *TaskError
+	if err := c.SubmitTasks(context.Background(), tasks); !errors.As(err, &taskErr) || taskErr.Message != answer {
+		t.Errorf("SubmitTasks = %v, want a TaskError", err)
+	}
+
+	answer, status = "wrong password", 401
+	var httpErr *HTTPError
+	if err := c.SubmitTasks(context.Background(), tasks); !errors.As(err, &httpErr) || httpErr.StatusCode != 401 || httpErr.Body != answer {
+		t.Errorf("SubmitTasks = %v, want an HTTPError", err)
+	}
+}
+
+func TestGetSample(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "secret" || strings.Contains(r.URL.RawQuery, "secret") {
+			t.Errorf("%s %s isn't authenticated with basic auth", r.Method, r.URL)
+		}
+		switch r.URL.Path {
+		case "/samples/aaaa":
+			w.Write([]byte("MZ"))
+		case "/samples/broken":
+			http.Error(w, "storage is down", 500)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	ctx := context.Background()
+
+	r, err := c.GetSample(ctx, "aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "MZ" {
+		t.Errorf("GetSample = %q", content)
+	}
+	var httpErr *HTTPError
+	if _, err := c.GetSample(ctx, "missing"); !errors.As(err, &httpErr) || httpErr.StatusCode != 404 {
+		t.Errorf("GetSample of a missing sample = %v, want a 404", err)
+	}
+
+	for hash, want := range map[string]bool{"aaaa": true, "missing": false} {
+		if ok, err := c.HasSample(ctx, hash); ok != want || err != nil {
+			t.Errorf("HasSample(%s) = %v, %v, want %v", hash, ok, err, want)
+		}
+	}
+	if _, err := c.HasSample(ctx, "broken"); !errors.As(err, &httpErr) || httpErr.StatusCode != 500 {
+		t.Errorf("HasSample of a broken sample = %v, want a 500", err)
+	}
+}
+
+func TestNetworkErrorTimeout(t *testing.T) {
+	block := make(chan struct{})
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(block)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := c.GetSample(ctx, "aaaa")
+	var netErr *NetworkError
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("GetSample after the deadline = %v, want a timeout", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = c.GetSample(ctx, "aaaa")
+	if !errors.As(err, &netErr) || netErr.Timeout() || !errors.Is(err, context.Canceled) {
+		t.Errorf("GetSample after cancelling = %v, want a cancelled request", err)
+	}
+}
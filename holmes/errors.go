@@ -0,0 +1,78 @@
+package holmes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrNoGateway is returned by NewClient if Config.GatewayURI is empty.
+var ErrNoGateway = errors.New("holmes: no gateway URI given")
+
+// HTTPError is returned if the gateway answered with a status other than 200.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	Body       string // the response, it usually explains what went wrong
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("holmes: the gateway returned %s", e.Status)
+}
+
+// TaskError is returned by SubmitTasks if the gateway rejected tasks. The
+// gateway answers with an empty body on success, anything else is an error.
+type TaskError struct {
+	Message string
+}
+
+func (e *TaskError) Error() string {
+	return "holmes: tasking failed: " + e.Message
+}
+
+// NetworkError is returned if a request couldn't be sent or its response
+// couldn't be read.
+type NetworkError struct {
+	Op  string // e.g. "upload"
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("holmes: %s: %s", e.Op, e.Err)
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the request timed out, either because of a timeout
+// of the client or because the deadline of its context passed.
+func (e *NetworkError) Timeout() bool {
+	return IsTimeout(e.Err)
+}
+
+// IsTimeout reports whether err is or wraps a timeout of a network operation
+// or a passed deadline. It also works for errors of other packages, e.g. of a
+// reader passed to UploadSample.
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// ReadError is returned by UploadSample if the sample couldn't be read. Nothing
+// was sent to the gateway.
+type ReadError struct {
+	Err error
+}
+
+func (e *ReadError) Error() string {
+	return "holmes: reading sample: " + e.Err.Error()
+}
+
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// pathList is the value of a flag that can be given several times. Logs of
+// older versions hold a single path instead of a list.
+type pathList []string
+
+func (l *pathList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *pathList) Set(path string) error {
+	*l = append(*l, path)
+	return nil
+}
+
+func (l *pathList) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*l = nil
+		if path != "" {
+			*l = pathList{path}
+		}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// inputSettings of "-input-settings". Priority and weight decide how samples
+// of an input are scheduled: inputs with a higher priority always go first,
+// inputs of the same priority share the workers in proportion to their
+// weight. The others replace "-src", "-comment" and "-mime" for the samples
+// of the input, its tags are added to those of "-tags".
+type inputSettings struct {
+	Priority int      `json:"priority"`
+	Weight   int      `json:"weight"`
+	Source   string   `json:"source"`
+	Comment  string   `json:"comment"`
+	Tags     []string `json:"tags"`
+	Mime     string   `json:"mime"`
+}
+
+// input is a source of samples like a "-dir" or a "-file", with its own
+// settings and queue
+type input struct {
+	kind  string // "file", "dir", "stream", "pcap" or "mirror"
+	path  string // of "-file" or "-dir"
+	root  string // absolute path of "-dir", paths of samples are relative to it
+	label string // recorded in the log, if the run has several inputs
+	inputSettings
+
+	// guarded by the scheduler
+	queue []string
+	pass  float64 // virtual time of the next sample, grows by 1/weight per sample
+	done  bool    // nothing is added anymore
+}
+
+// inputOverrides holds the parsed "-input-settings", by the kind of an input
+// or the path of a "-dir" or "-file"
+var inputOverrides map[string]inputSettings
+
+func initInputSettings() error {
+	inputOverrides = map[string]inputSettings{}
+	if options.InputSettings == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(options.InputSettings), &inputOverrides); err != nil {
+		return err
+	}
+	for key, s := range inputOverrides {
+		if s.Weight < 0 {
+			return fmt.Errorf("weight of %s is negative", key)
+		}
+	}
+	return nil
+}
+
+// newInput creates an input with the flags as its settings, overridden by
+// those for its kind and then by those for its path
+func newInput(kind, path string) *input {
+	in := &input{kind: kind, path: path, inputSettings: inputSettings{
+		Weight:  1,
+		Source:  options.Source,
+		Comment: options.Comment,
+		Tags:    append([]string(nil), tags...),
+		Mime:    options.MimetypePattern,
+	}}
+	for _, key := range []string{kind, path} {
+		s, ok := inputOverrides[key]
+		if key == "" || !ok {
+			continue
+		}
+		if s.Priority != 0 {
+			in.Priority = s.Priority
+		}
+		if s.Weight != 0 {
+			in.Weight = s.Weight
+		}
+		if s.Source != "" {
+			in.Source = s.Source
+		}
+		if s.Comment != "" {
+			in.Comment = s.Comment
+		}
+		if s.Mime != "" {
+			in.Mime = s.Mime
+		}
+		in.Tags = append(in.Tags, s.Tags...)
+	}
+	return in
+}
+
+// annotate records the input in the event of one of its samples
+func (in *input) annotate(e resultEvent) resultEvent {
+	e.Input = in.label
+	return e
+}
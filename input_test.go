@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPathListJSON(t *testing.T) {
+	for in, want := range map[string]pathList{
+		`"samples"`: {"samples"},
+		`""`:        nil,
+		`["a","b"]`: {"a", "b"},
+		`null`:      nil,
+	} {
+		var got pathList
+		if err := json.Unmarshal([]byte(in), &got); err != nil {
+			t.Errorf("unmarshal %s: %s", in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unmarshal %s = %#v, want %#v", in, got, want)
+		}
+	}
+}
+
+func TestUploadInputs(t *testing.T) {
+	g := newFakeGateway(t)
+	dir := setupRun(t, g)
+	a := writeFile(t, "feed-a/a.exe", "aaa")
+	b := writeFile(t, "feed-b/b.exe", "bbb")
+	c := writeFile(t, "c.exe", "ccc")
+	feedA, feedB := filepath.Join(dir, "feed-a"), filepath.Join(dir, "feed-b")
+	list := writeFile(t, "list", c+"\n")
+	options.Directory = pathList{feedA, feedB}
+	options.FPath = pathList{list}
+	options.Source = "src"
+	options.TagsStr = `["all"]`
+	options.InputSettings = `{"file":{"priority":1,"comment":"urgent"},"` + feedA + `":{"source":"a","tags":["feed-a"]},"` + feedB + `":{"mime":"image/png"}}`
+
+	codes := runUpload(t)
+
+	if names := uploadedNames(g); !reflect.DeepEqual(names, []string{"a.exe", "c.exe"}) {
+		t.Fatalf("uploaded %v, want a.exe and c.exe", names)
+	}
+	want := map[string]string{a: "200\t" + sha256sum("aaa") + "\t\t" + feedA, c: "200\t" + sha256sum("ccc") + "\t\t" + list}
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("log = %v, want %v", codes, want)
+	}
+	if _, ok := g.upload("b.exe"); ok {
+		t.Errorf("%s was uploaded, but doesn't match the mime-type of its input", b)
+	}
+
+	u, _ := g.upload("a.exe")
+	if u.Fields.Get("source") != "a" || !reflect.DeepEqual(u.Fields["tags"], []string{"all", "feed-a"}) || u.Fields.Get("path") != "a.exe" {
+		t.Errorf("a.exe was uploaded with %v, want the settings of feed-a", u.Fields)
+	}
+	u, _ = g.upload("c.exe")
+	if u.Fields.Get("source") != "src" || u.Fields.Get("comment") != "urgent" || !reflect.DeepEqual(u.Fields["tags"], []string{"all"}) {
+		t.Errorf("c.exe was uploaded with %v, want the settings of the list", u.Fields)
+	}
+}
+
+func sha256sum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mailAttachment is a file attached to a mail
+type mailAttachment struct {
+	Name    string
+	Content []byte
+}
+
+var mailWordDecoder = &mime.WordDecoder{}
+
+// mailInfo is what is known about the mail an attachment came from
+type mailInfo struct {
+	MessageID string
+	Sender    string
+	Subject   string
+	Date      time.Time
+}
+
+func describeMail(msg *mail.Message) mailInfo {
+	info := mailInfo{
+		MessageID: strings.Trim(strings.TrimSpace(msg.Header.Get("Message-Id")), "<>"),
+		Sender:    strings.TrimSpace(msg.Header.Get("From")),
+	}
+	if addr, err := mail.ParseAddress(info.Sender); err == nil {
+		info.Sender = addr.Address
+	}
+	info.Subject = msg.Header.Get("Subject")
+	if decoded, err := mailWordDecoder.DecodeHeader(info.Subject); err == nil {
+		info.Subject = decoded
+	}
+	info.Date, _ = msg.Header.Date()
+	return info
+}
+
+// tags of the attachments of a mail
+func (m mailInfo) tags() []string {
+	tags := []string{}
+	if m.Sender != "" {
+		tags = append(tags, "sender:"+m.Sender)
+	}
+	if m.MessageID != "" {
+		tags = append(tags, "message-id:"+m.MessageID)
+	}
+	return tags
+}
+
+// comment of the attachments of a mail, from is the sender or a description
+// of it
+func (m mailInfo) comment(from string) string {
+	comment := "attachment of a mail from " + from
+	if m.Subject != "" {
+		comment += ": " + m.Subject
+	}
+	return comment
+}
+
+// isMail reports if a file of "-dir" is an EML file or an mbox mailbox
+func isMail(path, mimetype string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".eml", ".mbox", ".mbx":
+		return true
+	}
+	return mimetype == "message/rfc822" || mimetype == "application/mbox"
+}
+
+// queueMail hands the attachments of the mails in an EML file or an mbox
+// mailbox to the workers, as mail:<path>/<message>/<attachment>/<name>
+func queueMail(in *input, path string, fi os.FileInfo) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		warning.Println("mail error (skipping "+path+"):", err)
+		return
+	}
+	messages := [][]byte{data}
+	if bytes.HasPrefix(data, []byte("From ")) {
+		messages = splitMbox(data)
+	}
+
+	for i, raw := range messages {
+		if cancelled() {
+			return
+		}
+		msg, attachments, err := mailAttachments(raw)
+		if err != nil {
+			// the attachments before the error are still uploaded
+			warning.Printf("mail error in message %d of %s: %s\n", i+1, path, err)
+		}
+		if msg == nil {
+			continue
+		}
+		info := describeMail(msg)
+		from := info.Sender
+		if from == "" {
+			from = "an unknown sender"
+		}
+		for j, a := range attachments {
+			meta := sampleMeta{
+				Name:    objectName(a.Name, "attachment"),
+				Comment: info.comment(from),
+				Tags:    info.tags(),
+			}
+			if options.DateFrom == "mtime" {
+				// the date of the mail is more precise than the mtime of the file
+				meta.Date = info.Date
+				if meta.Date.IsZero() {
+					meta.Date = fi.ModTime()
+				}
+			}
+			name := fmt.Sprintf("%s/%d/%d/%s", path, i+1, j+1, meta.Name)
+			queueStreamEntry(in, "mail", name, &streamEntry{content: a.Content, meta: meta})
+		}
+	}
+}
+
+// splitMbox returns the messages of an mbox mailbox. A line starting with
+// "From " after an empty line starts a message, lines like ">From " are
+// unescaped.
+func splitMbox(data []byte) [][]byte {
+	var (
+		messages [][]byte
+		current  []byte
+		blank    = true
+	)
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if blank && bytes.HasPrefix(line, []byte("From ")) {
+			if current != nil {
+				messages = append(messages, current)
+			}
+			current, blank = []byte{}, false
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if unescaped := bytes.TrimLeft(line, ">"); len(unescaped) < len(line) && bytes.HasPrefix(unescaped, []byte("From ")) {
+			line = line[1:]
+		}
+		current = append(current, line...)
+		blank = len(bytes.TrimRight(line, "\r\n")) == 0
+	}
+	if current != nil {
+		messages = append(messages, current)
+	}
+	return messages
+}
+
+// mailAttachments returns all attachments of a mail. Parts are attachments
+// if they have a filename or are marked as one.
+func mailAttachments(raw []byte) (*mail.Message, []mailAttachment, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	attachments, err := mimeAttachments(textproto.MIMEHeader(msg.Header), msg.Body)
+	return msg, attachments, err
+}
+
+// mimeAttachments walks a MIME part and its children, attached mails are
+// searched for attachments as well
+func mimeAttachments(header textproto.MIMEHeader, body io.Reader) ([]mailAttachment, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if mediaType == "message/rfc822" {
+		msg, err := mail.ReadMessage(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+		if err != nil {
+			return nil, err
+		}
+		return mimeAttachments(textproto.MIMEHeader(msg.Header), msg.Body)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		attachments := []mailAttachment{}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return attachments, nil
+			}
+			if err != nil {
+				return attachments, err
+			}
+			children, err := mimeAttachments(part.Header, part)
+			attachments = append(attachments, children...)
+			if err != nil {
+				return attachments, err
+			}
+		}
+	}
+
+	name := ""
+	disposition, dispParams, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err == nil {
+		name = dispParams["filename"]
+	}
+	if name == "" {
+		name = params["name"]
+	}
+	if decoded, err := mailWordDecoder.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	if name == "" && disposition != "attachment" {
+		// the text of the mail
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return nil, err
+	}
+	return []mailAttachment{{Name: name, Content: content}}, nil
+}
+
+func decodeTransferEncoding(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// the decoder skips line breaks
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSplitMbox(t *testing.T) {
+	mbox := "From alice Mon Jan  1 00:00:00 2024\nSubject: a\n\n>From the start\n>From here\n\n" +
+		"From bob Mon Jan  1 00:00:00 2024\nSubject: b\n\n>>From there\n"
+	messages := splitMbox([]byte(mbox))
+	got := []string{}
+	for _, m := range messages {
+		got = append(got, string(m))
+	}
+	want := []string{
+		"Subject: a\n\nFrom the start\nFrom here\n\n",
+		"Subject: b\n\n>From there\n",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %q, want %q", got, want)
+	}
+}
+
+func TestUploadMail(t *testing.T) {
+	g := newFakeGateway(t)
+	dir := setupRun(t, g)
+
+	eml := strings.Join([]string{
+		"From: Mallory <mallory@example.com>",
+		"Subject: =?utf-8?q?Ihre_Bestellung?=",
+		"Message-ID: <1234@example.com>",
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000",
+		"Content-Type: multipart/mixed; boundary=outer",
+		"",
+		"--outer",
+		"Content-Type: text/plain",
+		"",
+		"see attached",
+		"--outer",
+		"Content-Type: application/octet-stream",
+		"Content-Transfer-Encoding: base64",
+		"Content-Disposition: attachment; filename=\"=?utf-8?q?Rechnung_M=C3=A4rz.exe?=\"",
+		"",
+		"TVogZXZpbA==",
+		"--outer",
+		"Content-Type: text/plain; name=notes.txt",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"caf=C3=A9 =",
+		"au lait",
+		"--outer",
+		"Content-Type: message/rfc822",
+		"",
+		"From: someone@example.org",
+		"Subject: forwarded",
+		"Content-Type: multipart/mixed; boundary=inner",
+		"",
+		"--inner",
+		"Content-Type: application/zip",
+		"Content-Disposition: attachment; filename=inner.zip",
+		"",
+		"PK",
+		"--inner--",
+		"--outer--",
+		"",
+	}, "\r\n")
+	writeFile(t, filepath.Join(dir, "samples", "order.eml"), eml)
+	mbox := "From a@example.com Mon Jan  1 00:00:00 2024\n" +
+		"From: a@example.com\nContent-Type: multipart/mixed; boundary=x\n\n" +
+		"--x\nContent-Disposition: attachment; filename=first.txt\n\n>From me\n--x--\n\n" +
+		"From b@example.com Mon Jan  1 00:00:00 2024\n" +
+		"From: b@example.com\nContent-Type: multipart/mixed; boundary=x\n\n" +
+		"--x\nContent-Disposition: attachment; filename=second.txt\n\nsecond\n--x--\n"
+	writeFile(t, filepath.Join(dir, "samples", "box.mbox"), mbox)
+	writeFile(t, filepath.Join(dir, "samples", "plain.bin"), "plain")
+	options.Directory = pathList{filepath.Join(dir, "samples")}
+	options.Mail = true
+	options.DateFrom = "mtime"
+
+	codes := runUpload(t)
+
+	eml, mbox = filepath.Join(dir, "samples", "order.eml"), filepath.Join(dir, "samples", "box.mbox")
+	want := []struct{ sample, name, content string }{
+		{"mail:" + eml + "/1/1/Rechnung%20M%C3%A4rz.exe", "Rechnung März.exe", "MZ evil"},
+		{"mail:" + eml + "/1/2/notes.txt", "notes.txt", "café au lait"},
+		{"mail:" + eml + "/1/3/inner.zip", "inner.zip", "PK"},
+		{"mail:" + mbox + "/1/1/first.txt", "first.txt", "From me"},
+		{"mail:" + mbox + "/2/1/second.txt", "second.txt", "second"},
+		{filepath.Join(dir, "samples", "plain.bin"), "plain.bin", "plain"},
+	}
+	names := []string{}
+	for _, w := range want {
+		if codes[w.sample] != "200" {
+			t.Errorf("%s was logged as %q", w.sample, codes[w.sample])
+		}
+		names = append(names, w.name)
+		if u, ok := g.upload(w.name); ok && string(u.Content) != w.content {
+			t.Errorf("%s = %q, want %q", w.name, u.Content, w.content)
+		}
+	}
+	sort.Strings(names)
+	if got := uploadedNames(g); !reflect.DeepEqual(got, names) {
+		t.Fatalf("uploaded %v, want %v, log = %v", got, names, codes)
+	}
+
+	u, _ := g.upload("Rechnung März.exe")
+	if !reflect.DeepEqual(u.Fields["tags"], []string{"sender:mallory@example.com", "message-id:1234@example.com"}) {
+		t.Errorf("tags = %q", u.Fields["tags"])
+	}
+	if u.Fields.Get("comment") != "attachment of a mail from mallory@example.com: Ihre Bestellung" {
+		t.Errorf("comment = %q", u.Fields.Get("comment"))
+	}
+	if u.Fields.Get("date") != "2006-01-02T15:04:05Z" {
+		t.Errorf("date = %q, want the date of the mail", u.Fields.Get("date"))
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sidecar is the content of a metadata file next to a sample,
+// e.g. sample.exe.meta.json
+type sidecar struct {
+	Name    string    `json:"name"`
+	Source  string    `json:"source"`
+	Comment string    `json:"comment"`
+	Tags    []string  `json:"tags"`
+	Date    time.Time `json:"date"`
+}
+
+// metaMapping holds the rows of the "-meta-csv" file by sample
+var metaMapping map[string]sampleMeta
+
+// loadMetaMapping reads the mapping CSV. Its first row names the columns,
+// "sample" is required, "name", "source", "comment" and "tags" are optional.
+// Tags are separated by semicolons. Samples are matched by the line of the
+// sample list or the path in the directory, or by their base name.
+func loadMetaMapping(path string) error {
+	metaMapping = map[string]sampleMeta{}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	columns := map[string]int{}
+	for i, column := range header {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	if _, ok := columns["sample"]; !ok {
+		return errors.New("the mapping CSV has no \"sample\" column")
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[i])
+		}
+
+		meta := sampleMeta{
+			Name:    field("name"),
+			Source:  field("source"),
+			Comment: field("comment"),
+		}
+		for _, tag := range strings.Split(field("tags"), ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				meta.Tags = append(meta.Tags, tag)
+			}
+		}
+		metaMapping[field("sample")] = meta
+	}
+}
+
+// isSidecar reports whether a file in the directory is the metadata of
+// another sample and should not be uploaded itself
+func isSidecar(path string) bool {
+	if options.Sidecars && strings.HasSuffix(path, options.SidecarSuffix) {
+		return true
+	}
+	if options.MetaCSV != "" {
+		if abs, err := filepath.Abs(options.MetaCSV); err == nil && abs == path {
+			return true
+		}
+	}
+	return false
+}
+
+// readSidecar returns the metadata stored next to a local sample
+func readSidecar(name string) (*sampleMeta, error) {
+	f, err := os.Open(name + options.SidecarSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &sidecar{}
+	err = json.NewDecoder(f).Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	return &sampleMeta{Name: s.Name, Source: s.Source, Comment: s.Comment, Tags: s.Tags, Date: s.Date}, nil
+}
+
+// pathTagTemplates holds the parsed "-path-tags"
+var pathTagTemplates []string
+
+// matchPathPattern matches the components of a relative path against
+// "-path-pattern", e.g. "{family}/*/{hash}". Components in braces are
+// captured by their name, "*" matches anything.
+func matchPathPattern(rel string) (map[string]string, bool) {
+	if options.PathPattern == "" {
+		return nil, false
+	}
+	pattern := strings.Split(options.PathPattern, "/")
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(pattern) != len(parts) {
+		return nil, false
+	}
+
+	captures := map[string]string{}
+	for i, p := range pattern {
+		switch {
+		case p == "*":
+		case strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}"):
+			captures[p[1:len(p)-1]] = parts[i]
+		case p != parts[i]:
+			return nil, false
+		}
+	}
+	return captures, true
+}
+
+// pathMetadata derives the relative path, the date and tags of a sample from
+// its location in the "-dir" of its input and its modification time
+func pathMetadata(in *input, sample string) (*sampleMeta, error) {
+	meta := &sampleMeta{}
+	if options.DateFrom == "mtime" {
+		if fi, err := os.Stat(sample); err == nil {
+			meta.Date = fi.ModTime()
+		}
+	}
+
+	if in.root == "" || !strings.HasPrefix(sample, in.root+string(filepath.Separator)) {
+		return meta, nil
+	}
+	rel, err := filepath.Rel(in.root, sample)
+	if err != nil {
+		return meta, nil
+	}
+	meta.Path = filepath.ToSlash(rel)
+
+	captures, ok := matchPathPattern(rel)
+	if !ok {
+		return meta, nil
+	}
+	for _, template := range pathTagTemplates {
+		tag := template
+		for name, value := range captures {
+			tag = strings.Replace(tag, "{"+name+"}", value, -1)
+		}
+		meta.Tags = append(meta.Tags, tag)
+	}
+	if options.DateFrom == "path" {
+		if value, ok := captures["date"]; ok {
+			date, err := time.Parse(options.DateLayout, value)
+			if err != nil {
+				return nil, fmt.Errorf("can't parse date of %s: %s", sample, err)
+			}
+			meta.Date = date
+		}
+	}
+	return meta, nil
+}
+
+// resolveMetadata merges all metadata known about a sample. From lowest to
+// highest precedence, these are: the settings of its input, the location and
+// modification time of the file, the metadata the source of the sample knows
+// (CRITs, mirror), the row in the mapping CSV and the sidecar file. Name,
+// source, comment and date are taken from the highest one that sets them,
+// the tags of all of them are combined.
+func resolveMetadata(in *input, sample, filename string, fromSource *sampleMeta) (sampleMeta, error) {
+	meta := sampleMeta{
+		Name:    filename,
+		Source:  in.Source,
+		Comment: in.Comment,
+		Tags:    append([]string(nil), in.Tags...),
+	}
+
+	fromPath, err := pathMetadata(in, sample)
+	if err != nil {
+		return meta, err
+	}
+
+	layers := []*sampleMeta{fromPath, fromSource}
+	if m, ok := metaMapping[sample]; ok {
+		layers = append(layers, &m)
+	} else if m, ok := metaMapping[filepath.Base(sample)]; ok {
+		layers = append(layers, &m)
+	}
+	if options.Sidecars {
+		s, err := readSidecar(sample)
+		if err != nil {
+			return meta, err
+		}
+		layers = append(layers, s)
+	}
+
+	seen := map[string]struct{}{}
+	for _, tag := range meta.Tags {
+		seen[tag] = struct{}{}
+	}
+	for _, layer := range layers {
+		if layer == nil {
+			continue
+		}
+		if layer.Name != "" {
+			meta.Name = layer.Name
+		}
+		if layer.Source != "" {
+			meta.Source = layer.Source
+		}
+		if layer.Comment != "" {
+			meta.Comment = layer.Comment
+		}
+		if !layer.Date.IsZero() {
+			meta.Date = layer.Date
+		}
+		if layer.Path != "" {
+			meta.Path = layer.Path
+		}
+		for _, tag := range layer.Tags {
+			if _, ok := seen[tag]; !ok {
+				seen[tag] = struct{}{}
+				meta.Tags = append(meta.Tags, tag)
+			}
+		}
+	}
+	return meta, nil
+}
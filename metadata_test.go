@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMetaMapping(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+
+	path := writeFile(t, "mapping.csv", " Sample ,Tags,Name,Source\n"+
+		"a.exe, x ; y;;,real.exe,feed\n"+
+		"/samples/b.exe\n")
+	if err := loadMetaMapping(path); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]sampleMeta{
+		"a.exe":          {Name: "real.exe", Source: "feed", Tags: []string{"x", "y"}},
+		"/samples/b.exe": {},
+	}
+	if !reflect.DeepEqual(metaMapping, want) {
+		t.Errorf("mapping = %+v, want %+v", metaMapping, want)
+	}
+
+	path = writeFile(t, "nosample.csv", "name,source\nreal.exe,feed\n")
+	if err := loadMetaMapping(path); err == nil || !strings.Contains(err.Error(), `no "sample" column`) {
+		t.Errorf("loadMetaMapping = %v, want the missing sample column", err)
+	}
+}
+
+func TestResolveMetadata(t *testing.T) {
+	day := time.Date(2016, 9, 25, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		csv        string // rows after the header, {sample} is the path of the sample
+		sidecar    string
+		fromSource *sampleMeta
+		want       sampleMeta
+	}{
+		{
+			name: "input only",
+			want: sampleMeta{Name: "a.exe", Source: "input", Tags: []string{"in"}, Path: "a.exe"},
+		},
+		{
+			name:       "source",
+			fromSource: &sampleMeta{Name: "crits.exe", Comment: "from crits", Date: day, Tags: []string{"crits", "in"}},
+			want:       sampleMeta{Name: "crits.exe", Source: "input", Comment: "from crits", Date: day, Tags: []string{"in", "crits"}, Path: "a.exe"},
+		},
+		{
+			name:       "csv by path over the source",
+			csv:        "{sample},csv.exe,,csv\n",
+			fromSource: &sampleMeta{Name: "crits.exe", Source: "crits", Tags: []string{"crits"}},
+			want:       sampleMeta{Name: "csv.exe", Source: "crits", Tags: []string{"in", "crits", "csv"}, Path: "a.exe"},
+		},
+		{
+			name: "csv by base name",
+			csv:  "a.exe,,feed,\n",
+			want: sampleMeta{Name: "a.exe", Source: "feed", Tags: []string{"in"}, Path: "a.exe"},
+		},
+		{
+			name: "csv by path over the base name",
+			csv:  "a.exe,base.exe,,\n{sample},path.exe,,\n",
+			want: sampleMeta{Name: "path.exe", Source: "input", Tags: []string{"in"}, Path: "a.exe"},
+		},
+		{
+			name:    "sidecar over the csv",
+			csv:     "{sample},csv.exe,csv-feed,csv\n",
+			sidecar: `{"name": "sidecar.exe", "tags": ["sidecar", "csv"], "date": "2016-09-25T00:00:00Z"}`,
+			want:    sampleMeta{Name: "sidecar.exe", Source: "csv-feed", Date: day, Tags: []string{"in", "csv", "sidecar"}, Path: "a.exe"},
+		},
+	}
+	for _, tt := range tests {
+		dir := setupRun(t, newFakeGateway(t))
+		options.Source, tags = "input", []string{"in"}
+		sample := writeFile(t, filepath.Join("root", "a.exe"), "aaa")
+		in := newInput("dir", "")
+		in.root = filepath.Join(dir, "root")
+
+		if tt.csv != "" {
+			csv := "sample,name,source,tags\n" + strings.Replace(tt.csv, "{sample}", sample, -1)
+			if err := loadMetaMapping(writeFile(t, "mapping.csv", csv)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.sidecar != "" {
+			options.Sidecars = true
+			writeFile(t, sample+options.SidecarSuffix, tt.sidecar)
+		}
+
+		got, err := resolveMetadata(in, sample, "a.exe", tt.fromSource)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchPathPattern(t *testing.T) {
+	tests := []struct {
+		pattern, rel string
+		want         map[string]string
+	}{
+		{"{family}/*/{hash}", "emotet/2016/abcd", map[string]string{"family": "emotet", "hash": "abcd"}},
+		{"{family}/*/{hash}", "emotet/abcd", nil},
+		{"malware/{family}", "goodware/putty", nil},
+		{"malware/{family}", "malware/zeus", map[string]string{"family": "zeus"}},
+		{"", "emotet/abcd", nil},
+	}
+	for _, tt := range tests {
+		options.PathPattern = tt.pattern
+		got, ok := matchPathPattern(tt.rel)
+		if ok != (tt.want != nil) || ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("matchPathPattern(%q, %q) = %v, %v, want %v", tt.pattern, tt.rel, got, ok, tt.want)
+		}
+	}
+	options.PathPattern = ""
+}
+
+func TestPathMetadata(t *testing.T) {
+	mtime := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name                 string
+		rel                  string
+		dateFrom, dateLayout string
+		pattern, pathTags    string
+		want                 sampleMeta
+		wantErr              string
+	}{
+		{
+			name: "path only", rel: "emotet/a.exe", dateFrom: "now",
+			want: sampleMeta{Path: "emotet/a.exe"},
+		},
+		{
+			name: "mtime", rel: "a.exe", dateFrom: "mtime",
+			want: sampleMeta{Path: "a.exe", Date: mtime},
+		},
+		{
+			name: "tags and date from the path", rel: "emotet/2016-09-25/a.exe", dateFrom: "path", dateLayout: "2006-01-02",
+			pattern: "{family}/{date}/*", pathTags: `["family:{family}", "{family}-{date}", "static"]`,
+			want: sampleMeta{Path: "emotet/2016-09-25/a.exe", Date: time.Date(2016, 9, 25, 0, 0, 0, 0, time.UTC),
+				Tags: []string{"family:emotet", "emotet-2016-09-25", "static"}},
+		},
+		{
+			name: "date layout", rel: "20160925/a.exe", dateFrom: "path", dateLayout: "20060102",
+			pattern: "{date}/*",
+			want:    sampleMeta{Path: "20160925/a.exe", Date: time.Date(2016, 9, 25, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "date from the path without a match", rel: "other/a.exe", dateFrom: "path", dateLayout: "2006-01-02",
+			pattern: "{date}/x/*", pathTags: `["{date}"]`,
+			want: sampleMeta{Path: "other/a.exe"},
+		},
+		{
+			name: "unparsable date", rel: "yesterday/a.exe", dateFrom: "path", dateLayout: "2006-01-02",
+			pattern: "{date}/*",
+			wantErr: "can't parse date of",
+		},
+	}
+	for _, tt := range tests {
+		dir := setupRun(t, newFakeGateway(t))
+		options.DateFrom, options.DateLayout, options.PathPattern = tt.dateFrom, tt.dateLayout, tt.pattern
+		if tt.pathTags != "" {
+			if err := json.Unmarshal([]byte(tt.pathTags), &pathTagTemplates); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sample := writeFile(t, filepath.Join("root", tt.rel), "aaa")
+		if err := os.Chtimes(sample, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		in := newInput("dir", "")
+		in.root = filepath.Join(dir, "root")
+
+		got, err := pathMetadata(in, sample)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !got.Date.Equal(tt.want.Date) {
+			t.Errorf("%s: date = %s, want %s", tt.name, got.Date, tt.want.Date)
+		}
+		got.Date = tt.want.Date
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestPathMetadataOutsideRoot(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	options.PathPattern, pathTagTemplates = "*", []string{"tag"}
+	sample := writeFile(t, "a.exe", "aaa")
+
+	// samples of "-file" lists have no root, those outside of it get nothing
+	for _, root := range []string{"", filepath.Join(filepath.Dir(sample), "root")} {
+		in := newInput("dir", "")
+		in.root = root
+		got, err := pathMetadata(in, sample)
+		if err != nil || !reflect.DeepEqual(*got, sampleMeta{}) {
+			t.Errorf("root %q: got %+v, %v, want nothing", root, got, err)
+		}
+	}
+}
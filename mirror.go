@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Toolbox/holmes"
+)
+
+// submission is how Holmes-Storage records an upload of a sample
+type submission struct {
+	SHA256  string    `json:"sha256"`
+	Source  string    `json:"source"`
+	Date    time.Time `json:"date"`
+	ObjName string    `json:"obj_name"`
+	Tags    []string  `json:"tags"`
+	Comment string    `json:"comment"`
+}
+
+// mirrorGateway is the gateway samples are mirrored from
+var mirrorGateway *holmes.Client
+
+// holmesSource downloads holmes:<sha256> from the gateway given by "-from"
+// of the mirror subcommand, together with the metadata of its submissions
+type holmesSource struct{}
+
+func (holmesSource) Open(u *url.URL) (io.ReadCloser, string, error) {
+	if mirrorGateway == nil {
+		return nil, "", fmt.Errorf("no gateway to mirror from specified")
+	}
+	hash := u.Opaque
+	if hash == "" {
+		hash = strings.TrimPrefix(u.Host+u.Path, "/")
+	}
+
+	submissions, err := fetchSubmissions(mirrorGateway, hash)
+	if err != nil {
+		return nil, "", err
+	}
+	content, err := fetchStoredSample(mirrorGateway, hash)
+	if err != nil {
+		return nil, "", err
+	}
+
+	meta := mergeSubmissions(submissions)
+	if meta.Name == "" {
+		meta.Name = hash
+	}
+	return &sampleFile{ReadCloser: ioutil.NopCloser(bytes.NewReader(content)), meta: meta}, meta.Name, nil
+}
+
+// fetchSubmissions asks the gateway for all submissions of a sample
+func fetchSubmissions(from *holmes.Client, hash string) ([]submission, error) {
+	uri := strings.NewReplacer("{gateway}", from.Config().GatewayURI, "{sha256}", url.QueryEscape(hash)).Replace(options.SubmissionsURI)
+	resp, err := from.Get(rootCtx, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer SafeResponseClose(resp)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching submissions returned %s", resp.Status)
+	}
+
+	submissions := []submission{}
+	return submissions, json.NewDecoder(resp.Body).Decode(&submissions)
+}
+
+// mergeSubmissions keeps the name, source, comment and date of the first
+// submission and the tags of all of them
+func mergeSubmissions(submissions []submission) sampleMeta {
+	meta := sampleMeta{}
+	if len(submissions) == 0 {
+		return meta
+	}
+	sort.Slice(submissions, func(i, j int) bool {
+		return submissions[i].Date.Before(submissions[j].Date)
+	})
+
+	first := submissions[0]
+	meta.Name = first.ObjName
+	meta.Source = first.Source
+	meta.Comment = first.Comment
+	meta.Date = first.Date
+
+	seen := map[string]struct{}{}
+	for _, s := range submissions {
+		for _, tag := range s.Tags {
+			if _, ok := seen[tag]; !ok {
+				seen[tag] = struct{}{}
+				meta.Tags = append(meta.Tags, tag)
+			}
+		}
+	}
+	return meta
+}
+
+// queueMirror queues a sample of the source gateway, unless the destination
+// already has it
+func queueMirror(in *input, hash string) {
+	sample := "holmes:" + hash
+	if _, resumed := processed[sample]; !(resume && resumed) && alreadyMirrored(hash) {
+		info.Printf("Skipping sample %s, because the destination already has it\n", sample)
+		wg.Add(1)
+		recordSkip()
+		logC <- in.annotate(skipEvent(sample, "", ""))
+		return
+	}
+	queueSample(in, sample)
+}
+
+// alreadyMirrored reports whether the destination gateway has a sample
+func alreadyMirrored(hash string) bool {
+	ok, err := gateway.HasSample(rootCtx, hash)
+	if err != nil {
+		warning.Printf("Couldn't check whether the destination has %s: %s\n", hash, err)
+		return false
+	}
+	return ok
+}
+
+func main_mirror(args []string) {
+	fs := flag.NewFlagSet("mirror", flag.ExitOnError)
+	fs.StringVar(&resumeLog, "resume", "", "Path to the log-file of a previously unfinished mirror. If this parameter is used, all the others (except for 'workers' and the passwords, which are asked for if not given again) are overwritten with the saved values from the log")
+	fs.StringVar(&options.MirrorFrom, "from", "", "The URI of the master-gateway to copy samples from.")
+	fs.StringVar(&options.MirrorUser, "from-user", "", "Your username for the master-gateway to copy samples from.")
+	fs.StringVar(&options.MirrorPassword, "from-pw", "", "Your password for the master-gateway to copy samples from. If this value is not set, you will be prompted for it.")
+	fs.StringVar(&options.SubmissionsURI, "submissions-uri", "{gateway}/submissions/?sha256={sha256}", "URI template to fetch the submissions of a sample. {gateway} and {sha256} are replaced")
+	fs.StringVar(&options.GatewayURI, "gateway", "", "The URI of the master-gateway to copy samples to.")
+	fs.StringVar(&options.Username, "user", "", "Your username for the master-gateway to copy samples to.")
+	fs.StringVar(&options.Password, "pw", "", "Your password for the master-gateway to copy samples to. If this value is not set, you will be prompted for it.")
+	fs.BoolVar(&options.Insecure, "insecure", false, "If set, disables certificate checking")
+	fs.Var(&options.FPath, "file", "File containing a list of SHA256-sums to copy. Can be given several times")
+	fs.StringVar(&options.MirrorTags, "tags", "", "Copy all samples with these tags (as json list), instead of a list of hashes")
+	fs.StringVar(&options.MirrorSource, "src", "", "Copy all samples from this source, instead of a list of hashes")
+	fs.IntVar(&numWorkers, "workers", 1, "Number of parallel workers")
+	fs.StringVar(&reportPath, "report", "", "Path to write a report of the mirror to, as HTML if it ends with .html, otherwise as json (optional)")
+	sinkFlags(fs)
+	timeoutFlags(fs)
+	fs.Parse(args)
+	start := time.Now()
+
+	// no log-file is created for a mirror that can't start
+	loadResumeLog()
+	if options.MirrorFrom == "" || options.GatewayURI == "" {
+		warning.Fatal("Please specify both gateways with \"-from\" and \"-gateway\"")
+	}
+	if len(options.FPath) == 0 && options.MirrorTags == "" && options.MirrorSource == "" {
+		warning.Fatal("Please specify either \"-file\" or \"-tags\"/\"-src\"")
+	}
+	initLogger()
+	if options.MirrorPassword == "" {
+		options.MirrorPassword = readPassword("Please input your password for the master-gateway to copy from: ")
+	}
+	if options.Password == "" {
+		options.Password = readPassword("Please input your password for the master-gateway to copy to: ")
+	}
+	setupClient()
+	var err error
+	mirrorGateway, err = holmes.NewClient(holmes.Config{
+		GatewayURI: options.MirrorFrom,
+		Username:   options.MirrorUser,
+		Password:   options.MirrorPassword,
+		HTTPClient: client,
+	})
+	if err != nil {
+		warning.Fatal("Couldn't set up the client for the master-gateway to copy from:", err)
+	}
+	initSources()
+
+	var hashes []string
+	if len(options.FPath) > 0 {
+		for _, path := range options.FPath {
+			var list []string
+			if list, err = readHashList(path); err != nil {
+				break
+			}
+			hashes = append(hashes, list...)
+		}
+	} else {
+		hashes, err = querySamples(mirrorGateway, options.MirrorTags, options.MirrorSource)
+	}
+	if err != nil {
+		warning.Fatal("Couldn't get the list of samples:", err)
+	}
+
+	info.Printf("Mirroring %d samples...\n", len(hashes))
+	startWorkers()
+	in := sched.add(newInput("mirror", ""))
+	for _, hash := range hashes {
+		if cancelled() {
+			break
+		}
+		queueMirror(in, hash)
+	}
+	sched.finish(in)
+	sched.close()
+	workers.Wait()
+	wg.Wait()
+	logStages()
+	writeReport(start)
+	closeSinks()
+
+	info.Println("==================")
+	info.Println("Finished execution")
+}
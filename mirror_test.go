@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	from, to := newFakeGateway(t), newFakeGateway(t)
+	setupRun(t, to)
+	a, b, c := "first sample", "second sample", "third sample"
+	for _, content := range []string{a, b, c} {
+		from.samples[sha256sum(content)] = []byte(content)
+	}
+	to.samples[sha256sum(b)] = []byte(b)
+	day := time.Date(2016, 9, 25, 0, 0, 0, 0, time.UTC)
+	from.submits[sha256sum(a)] = []submission{
+		{Source: "later", Date: day.AddDate(0, 0, 1), ObjName: "renamed.exe", Tags: []string{"emotet", "dropper"}},
+		{Source: "feed", Date: day, ObjName: "a.exe", Tags: []string{"emotet"}, Comment: "first seen"},
+	}
+	list := writeFile(t, "hashes", sha256sum(a)+"\n"+sha256sum(b)+"\n"+sha256sum(c)+"\n")
+
+	main_mirror([]string{"-from", from.URL, "-from-user", "test", "-from-pw", "test",
+		"-gateway", to.URL, "-user", "test", "-pw", "test", "-file", list})
+
+	// b is on the destination already, c has no submissions and keeps its hash as name
+	if got, want := uploadedNames(to), []string{"a.exe", sha256sum(c)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("uploaded %v, want %v", got, want)
+	}
+	u, _ := to.upload("a.exe")
+	if string(u.Content) != a {
+		t.Errorf("a.exe has content %q", u.Content)
+	}
+	if u.Fields.Get("source") != "feed" || u.Fields.Get("comment") != "first seen" || u.Fields.Get("date") != "2016-09-25T00:00:00Z" {
+		t.Errorf("a.exe was uploaded with %v, want the metadata of the first submission", u.Fields)
+	}
+	if !reflect.DeepEqual(u.Fields["tags"], []string{"emotet", "dropper"}) {
+		t.Errorf("tags = %q, want the tags of all submissions", u.Fields["tags"])
+	}
+	if codes := readLog(t, logFile.Name()); len(codes) != 3 {
+		t.Errorf("log = %v, want all three samples", codes)
+	}
+	if report.Skipped != 1 {
+		t.Errorf("%d samples were skipped, want the one on the destination", report.Skipped)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// types of the objects that can be tasked. Only files are downloaded by
+// Totem, the others are passed to the services as they are.
+const (
+	objectFile   = "file"
+	objectIP     = "ip"
+	objectDomain = "domain"
+	objectURL    = "url"
+)
+
+// defanged notations of indicators, as they are shared in reports
+var refanger = strings.NewReplacer(
+	"[.]", ".", "(.)", ".", "{.}", ".", "[dot]", ".", "(dot)", ".", "{dot}", ".",
+	"[:]", ":", "[://]", "://", "[/]", "/",
+	"[@]", "@", "[at]", "@",
+)
+
+var (
+	defangedScheme  = regexp.MustCompile(`(?i)^(hxxp|hxtp|fxp)(s?)://`)
+	refangedSchemes = map[string]string{"hxxp": "http", "hxtp": "http", "fxp": "ftp"}
+)
+
+// refang undoes the usual ways of defanging IPs, domains and URLs, like
+// hxxp://evil[.]example
+func refang(s string) string {
+	s = refanger.Replace(strings.TrimSpace(s))
+	if m := defangedScheme.FindStringSubmatch(s); m != nil {
+		s = refangedSchemes[strings.ToLower(m[1])] + strings.ToLower(m[2]) + "://" + s[len(m[0]):]
+	}
+	return s
+}
+
+// normalizeIP returns the canonical form of an IPv4 or IPv6 address
+func normalizeIP(s string) (string, error) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", fmt.Errorf("%q is not an IP address", s)
+	}
+	return ip.String(), nil
+}
+
+// normalizeDomain returns a domain lowercased and in its ASCII form. It has to
+// have at least two labels and must not be an IP address.
+func normalizeDomain(s string) (string, error) {
+	s = strings.TrimSuffix(s, ".")
+	if net.ParseIP(s) != nil {
+		return "", fmt.Errorf("%q is an IP address, not a domain", s)
+	}
+	ascii, err := idna.Lookup.ToASCII(s)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a valid domain: %s", s, err)
+	}
+	labels := strings.Split(ascii, ".")
+	if len(labels) < 2 || len(ascii) > 253 {
+		return "", fmt.Errorf("%q is not a valid domain", s)
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 {
+			return "", fmt.Errorf("%q is not a valid domain", s)
+		}
+	}
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return "", fmt.Errorf("%q has a numeric top-level domain", s)
+	}
+	return strings.ToLower(ascii), nil
+}
+
+// normalizeURL lowercases the scheme and the host of a URL and converts the
+// host to its ASCII form. URLs without a scheme are taken as http.
+func normalizeURL(s string) (string, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a valid URL: %s", s, err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	switch u.Scheme {
+	case "http", "https", "ftp", "ftps":
+	default:
+		return "", fmt.Errorf("%q has an unsupported scheme", s)
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		return "", fmt.Errorf("%q has no host", s)
+	}
+	if ip, err := normalizeIP(host); err == nil {
+		host = ip
+	} else if host, err = normalizeDomain(host); err != nil {
+		return "", err
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+	return u.String(), nil
+}
+
+// parseObject refangs and normalizes an object of the given type. If the type
+// is "auto", it is detected: a URL has a scheme, IPs are taken as such, other
+// objects with a dot are domains and everything else is a file.
+func parseObject(s, objectType string) (string, string, error) {
+	if objectType == objectFile {
+		return objectFile, s, nil
+	}
+	s = refang(s)
+	if s == "" {
+		return "", "", errors.New("empty object")
+	}
+
+	switch objectType {
+	case objectIP:
+		v, err := normalizeIP(s)
+		return objectIP, v, err
+	case objectDomain:
+		v, err := normalizeDomain(s)
+		return objectDomain, v, err
+	case objectURL:
+		v, err := normalizeURL(s)
+		return objectURL, v, err
+	case "auto":
+		if strings.Contains(s, "://") {
+			v, err := normalizeURL(s)
+			return objectURL, v, err
+		}
+		if v, err := normalizeIP(s); err == nil {
+			return objectIP, v, nil
+		}
+		if strings.Contains(s, ".") {
+			// hashes have no dots
+			v, err := normalizeDomain(s)
+			return objectDomain, v, err
+		}
+		return objectFile, s, nil
+	}
+	return "", "", fmt.Errorf("unknown object type %q", objectType)
+}
+
+// taskSets parses the tasks for each object type. IPs, domains and URLs get
+// the tasks of files, unless they have their own.
+func taskSets(fileTasks, ipTasks, domainTasks, urlTasks string) (map[string]map[string][]string, error) {
+	files := map[string][]string{}
+	if err := json.Unmarshal([]byte(fileTasks), &files); err != nil {
+		return nil, fmt.Errorf("Error while parsing list of tasks: %s", err)
+	}
+	sets := map[string]map[string][]string{objectFile: files}
+	for t, str := range map[string]string{objectIP: ipTasks, objectDomain: domainTasks, objectURL: urlTasks} {
+		sets[t] = files
+		if str == "" {
+			continue
+		}
+		tasks := map[string][]string{}
+		if err := json.Unmarshal([]byte(str), &tasks); err != nil {
+			return nil, fmt.Errorf("Error while parsing list of %s tasks: %s", t, err)
+		}
+		sets[t] = tasks
+	}
+	return sets, nil
+}
+
+// newTask builds the task of an object. Files are downloaded by their hash,
+// other objects are passed to the services as their URIs and filename.
+func newTask(objectType, value, filename, source string, tasks map[string][]string) Task {
+	task := Task{
+		PrimaryURI: value,
+		Filename:   filename,
+		Tasks:      tasks,
+		Tags:       tags,
+		Source:     source,
+		Comment:    options.Comment,
+		Download:   objectType == objectFile,
+	}
+	if !task.Download {
+		task.SecondaryURI, task.Filename = value, value
+	}
+	return task
+}
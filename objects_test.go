@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseObject(t *testing.T) {
+	tests := []struct {
+		in, objectType string
+		wantType, want string
+		wantErr        bool
+	}{
+		{"8.8.8.8", "ip", "ip", "8.8.8.8", false},
+		{"8[.]8[.]8[.]8", "ip", "ip", "8.8.8.8", false},
+		{"[2001:4860:4860:0:0:0:0:8888]", "ip", "ip", "2001:4860:4860::8888", false},
+		{"8.8.8", "ip", "", "", true},
+		{"Evil[.]Example[.]COM.", "domain", "domain", "evil.example.com", false},
+		{"bücher.example", "domain", "domain", "xn--bcher-kva.example", false},
+		{"localhost", "domain", "", "", true},
+		{"1.2.3.4", "domain", "", "", true},
+		{"under_score.example", "domain", "", "", true},
+		{"hxxps://Evil[.]example[:]8443/Path?Q=1", "url", "url", "https://evil.example:8443/Path?Q=1", false},
+		{"HXXP[://]bücher.example/a", "url", "url", "http://xn--bcher-kva.example/a", false},
+		{"evil.example/drop.exe", "url", "url", "http://evil.example/drop.exe", false},
+		{"fxp://[2001:db8::1]/x", "url", "url", "ftp://[2001:db8::1]/x", false},
+		{"javascript://alert(1)", "url", "", "", true},
+		{"hxxp://1.2.3.4/x", "auto", "url", "http://1.2.3.4/x", false},
+		{"2001:db8::1", "auto", "ip", "2001:db8::1", false},
+		{"evil[.]example", "auto", "domain", "evil.example", false},
+		{"0a4efbe854f1fa444303ca210842e779b55570216f62a4a406c89c564dabaf97", "auto", "file", "0a4efbe854f1fa444303ca210842e779b55570216f62a4a406c89c564dabaf97", false},
+		{"8.8.8.8", "file", "file", "8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		gotType, got, err := parseObject(tt.in, tt.objectType)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseObject(%q, %q) error = %v, want error %v", tt.in, tt.objectType, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (gotType != tt.wantType || got != tt.want) {
+			t.Errorf("parseObject(%q, %q) = %s %q, want %s %q", tt.in, tt.objectType, gotType, got, tt.wantType, tt.want)
+		}
+	}
+}
+
+func TestTaskingObjects(t *testing.T) {
+	g := newFakeGateway(t)
+	setupRun(t, g)
+	options.Tasking = true
+	options.ObjectType = "auto"
+	options.Tasks = `{"PEINFO": []}`
+	options.DomainTasks = `{"DNSMETA": []}`
+	options.FPath = pathList{writeFile(t, "list", "aaaa a.exe src1\n8[.]8[.]8[.]8 feed\nEvil[.]Example\n\nhxxp://evil[.]example/x\nunder_score[.]example feed\n")}
+	setupClient()
+
+	main_tasking()
+
+	got := g.Tasks()
+	if len(got) != 4 {
+		t.Fatalf("gateway got %d tasks, want 4: %+v", len(got), got)
+	}
+	want := []struct {
+		uri      string
+		download bool
+		source   string
+		tasks    map[string][]string
+	}{
+		{"aaaa", true, "src1", map[string][]string{"PEINFO": {}}},
+		{"8.8.8.8", false, "feed", map[string][]string{"PEINFO": {}}},
+		{"evil.example", false, "", map[string][]string{"DNSMETA": {}}},
+		{"http://evil.example/x", false, "", map[string][]string{"PEINFO": {}}},
+	}
+	for i, w := range want {
+		task := got[i]
+		if task.PrimaryURI != w.uri || task.Download != w.download || task.Source != w.source || !reflect.DeepEqual(task.Tasks, w.tasks) {
+			t.Errorf("task %d = %+v, want %+v", i, task, w)
+		}
+		if !task.Download && (task.Filename != w.uri || task.SecondaryURI != w.uri) {
+			t.Errorf("task %d has filename %q and secondary URI %q, want the object", i, task.Filename, task.SecondaryURI)
+		}
+	}
+}
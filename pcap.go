@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// link types of captures, only those carrying IP are supported
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkSLL      = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+)
+
+// lengths read from a capture are checked against these limits before
+// allocating a buffer, so that a corrupt file can't exhaust the memory. They
+// are the ones of Wireshark.
+const (
+	maxPacketLen      = 256 << 10
+	maxPcapNGBlockLen = 16 << 20
+)
+
+// TCP flags
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpACK = 0x10
+)
+
+// tcpPacket is a TCP segment of a capture
+type tcpPacket struct {
+	ts               time.Time
+	srcIP, dstIP     net.IP
+	srcPort, dstPort uint16
+	seq              uint32
+	flags            byte
+	payload          []byte
+}
+
+// readCapture calls fn for every packet of a pcap or pcapng file
+func readCapture(r io.Reader, fn func(ts time.Time, linkType uint32, data []byte)) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(magic) == 0x0a0d0d0a {
+		return readPcapNG(br, fn)
+	}
+	return readPcap(br, fn)
+}
+
+func readPcap(r io.Reader, fn func(ts time.Time, linkType uint32, data []byte)) error {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+
+	var order binary.ByteOrder
+	nano := false
+	switch magic := binary.LittleEndian.Uint32(header); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+		nano = magic == 0xa1b23c4d
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+		nano = magic == 0x4d3cb2a1
+	default:
+		return errors.New("not a pcap or pcapng file")
+	}
+	linkType := order.Uint32(header[20:]) & 0xffff
+
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		sec, frac := int64(order.Uint32(record)), int64(order.Uint32(record[4:]))
+		if !nano {
+			frac *= 1000
+		}
+		captured := order.Uint32(record[8:])
+		if captured > maxPacketLen {
+			return fmt.Errorf("invalid pcap packet length %d", captured)
+		}
+		data := make([]byte, captured)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		fn(time.Unix(sec, frac), linkType, data)
+	}
+}
+
+type pcapngInterface struct {
+	linkType uint32
+	tsUnit   time.Duration // per tick of a timestamp
+}
+
+func readPcapNG(r io.Reader, fn func(ts time.Time, linkType uint32, data []byte)) error {
+	var (
+		order      binary.ByteOrder = binary.LittleEndian
+		interfaces []pcapngInterface
+	)
+	head := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, head); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		blockType := order.Uint32(head)
+		if blockType == 0x0a0d0d0a {
+			// a new section, its byte order is given by the magic
+			magic := make([]byte, 4)
+			if _, err := io.ReadFull(r, magic); err != nil {
+				return err
+			}
+			order = binary.LittleEndian
+			if binary.BigEndian.Uint32(magic) == 0x1a2b3c4d {
+				order = binary.BigEndian
+			}
+			interfaces = nil
+			length := order.Uint32(head[4:])
+			if length < 28 || length%4 != 0 {
+				return fmt.Errorf("invalid pcapng block length %d", length)
+			}
+			if _, err := io.CopyN(ioutil.Discard, r, int64(length-12)); err != nil {
+				return err
+			}
+			continue
+		}
+		length := order.Uint32(head[4:])
+		if length < 12 || length%4 != 0 || length > maxPcapNGBlockLen {
+			return fmt.Errorf("invalid pcapng block length %d", length)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		body = body[:len(body)-4] // trailing length
+
+		switch blockType {
+		case 1: // interface description
+			if len(body) < 8 {
+				return errors.New("short pcapng interface block")
+			}
+			iface := pcapngInterface{linkType: uint32(order.Uint16(body)), tsUnit: time.Microsecond}
+			// options: if_tsresol (9) changes the unit of timestamps
+			for opts := body[8:]; len(opts) >= 4; {
+				code, optLen := order.Uint16(opts), int(order.Uint16(opts[2:]))
+				if code == 0 || 4+optLen > len(opts) {
+					break
+				}
+				if code == 9 && optLen >= 1 {
+					res := opts[4]
+					if res&0x80 == 0 {
+						iface.tsUnit = time.Second
+						for i := byte(0); i < res; i++ {
+							iface.tsUnit /= 10
+						}
+					} else {
+						iface.tsUnit = time.Second >> (res & 0x7f)
+					}
+					if iface.tsUnit == 0 {
+						iface.tsUnit = time.Nanosecond
+					}
+				}
+				opts = opts[4+(optLen+3)/4*4:]
+			}
+			interfaces = append(interfaces, iface)
+		case 6: // enhanced packet
+			if len(body) < 20 {
+				return errors.New("short pcapng packet block")
+			}
+			id := order.Uint32(body)
+			if int(id) >= len(interfaces) {
+				return fmt.Errorf("packet of unknown interface %d", id)
+			}
+			iface := interfaces[id]
+			ticks := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			captured := order.Uint32(body[12:])
+			if int(captured) > len(body)-20 {
+				return errors.New("short pcapng packet block")
+			}
+			fn(time.Unix(0, int64(ticks)*int64(iface.tsUnit)), iface.linkType, body[20:20+captured])
+		case 3: // simple packet, without a timestamp
+			if len(interfaces) == 0 || len(body) < 4 {
+				continue
+			}
+			captured := order.Uint32(body)
+			if int(captured) > len(body)-4 {
+				captured = uint32(len(body) - 4)
+			}
+			fn(time.Time{}, interfaces[0].linkType, body[4:4+captured])
+		}
+	}
+}
+
+// decodeTCP returns the TCP segment of a packet, if it is one. Fragmented IP
+// packets are ignored.
+func decodeTCP(linkType uint32, data []byte) (*tcpPacket, bool) {
+	var etherType uint16
+	switch linkType {
+	case linkEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:]), data[14:]
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			// VLAN tags
+			if len(data) < 4 {
+				return nil, false
+			}
+			etherType, data = binary.BigEndian.Uint16(data[2:]), data[4:]
+		}
+	case linkSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:]), data[16:]
+	case linkNull:
+		if len(data) < 4 {
+			return nil, false
+		}
+		data = data[4:]
+	case linkRaw, linkIPv4, linkIPv6, 12, 14: // 12 and 14 are raw IP on some BSDs
+	default:
+		return nil, false
+	}
+	if etherType != 0 && etherType != 0x0800 && etherType != 0x86dd {
+		return nil, false
+	}
+	if len(data) < 1 {
+		return nil, false
+	}
+
+	p := &tcpPacket{}
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		if data[9] != 6 || ihl < 20 || total < ihl || total > len(data) {
+			return nil, false
+		}
+		if binary.BigEndian.Uint16(data[6:])&0x3fff != 0 {
+			// more fragments or a fragment offset
+			return nil, false
+		}
+		p.srcIP, p.dstIP = append(net.IP(nil), data[12:16]...), append(net.IP(nil), data[16:20]...)
+		data = data[ihl:total]
+	case 6:
+		if len(data) < 40 {
+			return nil, false
+		}
+		next := data[6]
+		payloadLen := int(binary.BigEndian.Uint16(data[4:]))
+		p.srcIP, p.dstIP = append(net.IP(nil), data[8:24]...), append(net.IP(nil), data[24:40]...)
+		data = data[40:]
+		if payloadLen <= len(data) {
+			data = data[:payloadLen]
+		}
+		// skip extension headers, fragments are not supported
+		for next == 0 || next == 43 || next == 60 {
+			if len(data) < 8 {
+				return nil, false
+			}
+			extLen := (int(data[1]) + 1) * 8
+			if extLen > len(data) {
+				return nil, false
+			}
+			next, data = data[0], data[extLen:]
+		}
+		if next != 6 {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	if len(data) < 20 {
+		return nil, false
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || offset > len(data) {
+		return nil, false
+	}
+	p.srcPort = binary.BigEndian.Uint16(data)
+	p.dstPort = binary.BigEndian.Uint16(data[2:])
+	p.seq = binary.BigEndian.Uint32(data[4:])
+	p.flags = data[13]
+	p.payload = data[offset:]
+	return p, true
+}
+
+type tcpSegment struct {
+	seq  uint32
+	data []byte
+}
+
+// tcpHalf is one direction of a TCP connection
+type tcpHalf struct {
+	base     uint32 // sequence number of the first byte
+	haveBase bool
+	segments []tcpSegment
+	fin      bool
+}
+
+func (h *tcpHalf) add(p *tcpPacket) {
+	if p.flags&tcpSYN != 0 {
+		h.base, h.haveBase = p.seq+1, true
+	}
+	if p.flags&(tcpFIN|tcpRST) != 0 {
+		h.fin = true
+	}
+	if len(p.payload) > 0 {
+		h.segments = append(h.segments, tcpSegment{seq: p.seq, data: append([]byte(nil), p.payload...)})
+	}
+}
+
+// assemble returns the bytes of the stream in order. Retransmissions and
+// overlaps are dropped, complete is false if a segment is missing, in which
+// case the stream ends before the gap.
+func (h *tcpHalf) assemble() (stream []byte, complete bool) {
+	if len(h.segments) == 0 {
+		return nil, true
+	}
+	base := h.base
+	if !h.haveBase {
+		// the handshake is not in the capture, start at the earliest segment
+		base = h.segments[0].seq
+		for _, s := range h.segments {
+			if int32(s.seq-base) < 0 {
+				base = s.seq
+			}
+		}
+	}
+	sort.SliceStable(h.segments, func(i, j int) bool {
+		return int32(h.segments[i].seq-base) < int32(h.segments[j].seq-base)
+	})
+
+	for _, s := range h.segments {
+		offset := int64(int32(s.seq - base))
+		end := offset + int64(len(s.data))
+		if end <= int64(len(stream)) {
+			continue
+		}
+		if offset > int64(len(stream)) {
+			return stream, false
+		}
+		stream = append(stream, s.data[int64(len(stream))-offset:]...)
+	}
+	return stream, true
+}
+
+// tcpEndpoint is an address and port, formatted like host:port
+type tcpEndpoint struct {
+	ip   net.IP
+	port uint16
+}
+
+func (e tcpEndpoint) String() string {
+	return net.JoinHostPort(e.ip.String(), strconv.Itoa(int(e.port)))
+}
+
+// tcpConn is a reassembled TCP connection, the client opened it
+type tcpConn struct {
+	index          int // position in the capture, starting at 1
+	start          time.Time
+	client, server tcpEndpoint
+	toServer       tcpHalf
+	toClient       tcpHalf
+	clientToServer []byte
+	serverToClient []byte
+	complete       bool // no segments are missing in either direction
+}
+
+// reassembleTCP reads all TCP connections of a capture, in the order they
+// started. The whole capture is kept in memory. Without a handshake in the
+// capture, the side with the higher port is taken as the client.
+func reassembleTCP(r io.Reader) ([]*tcpConn, error) {
+	var (
+		conns []*tcpConn
+		open  = map[string]*tcpConn{}
+	)
+	err := readCapture(r, func(ts time.Time, linkType uint32, data []byte) {
+		p, ok := decodeTCP(linkType, data)
+		if !ok {
+			return
+		}
+		src, dst := tcpEndpoint{p.srcIP, p.srcPort}, tcpEndpoint{p.dstIP, p.dstPort}
+		key := src.String() + " " + dst.String()
+		if src.String() > dst.String() {
+			key = dst.String() + " " + src.String()
+		}
+
+		c, ok := open[key]
+		if ok && p.flags&(tcpSYN|tcpACK) == tcpSYN && (len(c.toServer.segments) > 0 || c.toServer.fin) {
+			// the ports are reused by a new connection
+			ok = false
+		}
+		if !ok {
+			c = &tcpConn{index: len(conns) + 1, start: ts, client: src, server: dst}
+			if p.flags&(tcpSYN|tcpACK) == tcpSYN|tcpACK || (p.flags&tcpSYN == 0 && p.srcPort < p.dstPort) {
+				c.client, c.server = dst, src
+			}
+			conns = append(conns, c)
+			open[key] = c
+		}
+		if p.srcPort == c.client.port && p.srcIP.Equal(c.client.ip) {
+			c.toServer.add(p)
+		} else {
+			c.toClient.add(p)
+		}
+	})
+
+	// a truncated capture still yields the connections read so far
+	for _, c := range conns {
+		var ok1, ok2 bool
+		c.clientToServer, ok1 = c.toServer.assemble()
+		c.serverToClient, ok2 = c.toClient.assemble()
+		c.complete = ok1 && ok2
+		c.toServer.segments, c.toClient.segments = nil, nil
+	}
+	return conns, err
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Toolbox/holmes"
+)
+
+// tasking states of a sample in the log-file, only used in pipeline mode
+const (
+	taskPending = "pending"
+	taskDone    = "tasked"
+	taskFailed  = "failed"
+)
+
+// a partially filled batch is sent after this time without new samples
+const pipelineFlushInterval = 5 * time.Second
+
+// resumeState is what is known about a successfully uploaded sample from a
+// previous log-file. SHA256 and TaskState are only set in pipeline mode.
+type resumeState struct {
+	SHA256    string
+	TaskState string
+}
+
+type pipelineTask struct {
+	name  string // name of the sample as it appears in the log-file
+	input *input
+	task  Task
+}
+
+var (
+	pipelineTasks map[string][]string
+	taskC         chan pipelineTask
+	taskerDone    chan struct{}
+)
+
+func initPipeline() {
+	err := json.Unmarshal([]byte(options.Tasks), &pipelineTasks)
+	if err != nil {
+		warning.Fatal("Error while parsing list of tasks:", err)
+	}
+	if options.BatchSize < 1 {
+		options.BatchSize = 1
+	}
+
+	taskC = make(chan pipelineTask, options.BatchSize)
+	taskerDone = make(chan struct{})
+	go tasker()
+}
+
+// closePipeline sends the last batch right away and waits for the tasker to
+// return. It has to be called once no sample is queued for tasking anymore,
+// i.e. after the inputs were read and all workers returned.
+func closePipeline() {
+	if taskC == nil {
+		return
+	}
+	close(taskC)
+	<-taskerDone
+	taskC = nil
+}
+
+// logLine formats a line of the log-file. The sha256sum and tasking state are
+// only appended in pipeline mode or if the run has several inputs, followed by
+// the input in the latter case.
+func logLine(e resultEvent) string {
+	line := e.Sample + "\t" + strconv.Itoa(e.Code)
+	if e.TaskState != "" || e.Input != "" {
+		line += "\t" + e.SHA256 + "\t" + e.TaskState
+	}
+	if e.Input != "" {
+		line += "\t" + e.Input
+	}
+	return line + "\n"
+}
+
+// queueTask marks an uploaded sample as pending in the log and hands it to the
+// tasker. Has to be called instead of logging the upload, as it accounts for
+// the additional log line written once the tasking finished. The task carries
+// the same metadata as the upload.
+func queueTask(in *input, name, sha256sum string, meta holmes.Metadata) {
+	filename := meta.Name
+	if filename == "" {
+		filename = filepath.Base(name)
+	}
+	wg.Add(1)
+	logC <- in.annotate(newEvent(name, 200, sha256sum, taskPending))
+	taskC <- pipelineTask{
+		name:  name,
+		input: in,
+		task: Task{
+			PrimaryURI: sha256sum,
+			Filename:   filename,
+			Tasks:      pipelineTasks,
+			Tags:       meta.Tags,
+			Source:     meta.Source,
+			Comment:    meta.Comment,
+			Download:   true,
+		},
+	}
+}
+
+// skipSample logs a sample that was already uploaded successfully in a
+// previous run. In pipeline mode, samples that were not tasked yet are queued
+// for tasking again.
+func skipSample(in *input, name string, state resumeState) {
+	info.Printf("Skipping sample %s, because it was already uploaded successfully\n", name)
+	recordSkip()
+	if !options.Pipeline {
+		logC <- in.annotate(skipEvent(name, "", ""))
+		return
+	}
+	if state.SHA256 == "" {
+		// uploaded by a run without pipeline, the hash is unknown
+		warning.Printf("Can't task %s, because its SHA256-sum is not in the log\n", name)
+		logC <- in.annotate(skipEvent(name, "", ""))
+		return
+	}
+	if state.TaskState == taskDone {
+		logC <- in.annotate(skipEvent(name, state.SHA256, taskDone))
+		return
+	}
+	// the sample isn't opened again, so the metadata comes from its path,
+	// the mapping CSV and its sidecar only
+	meta, err := resolveMetadata(in, name, filepath.Base(name), nil)
+	if err != nil {
+		warning.Printf("Couldn't resolve the metadata of %s, tasking it with the settings of its input: %s\n", name, err)
+	}
+	queueTask(in, name, state.SHA256, holmes.Metadata{
+		Name:    meta.Name,
+		Source:  meta.Source,
+		Comment: meta.Comment,
+		Tags:    meta.Tags,
+	})
+}
+
+// tasker collects uploaded samples and sends them to the gateway in batches
+// of options.BatchSize. It sends the last batch and returns, once taskC is
+// closed.
+func tasker() {
+	defer close(taskerDone)
+	batch := make([]pipelineTask, 0, options.BatchSize)
+	ticker := time.NewTicker(pipelineFlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		allTasks := make([]Task, len(batch))
+		for i, t := range batch {
+			allTasks[i] = t.task
+		}
+
+		state := taskDone
+		err := submitTasks(allTasks)
+		if err != nil {
+			warning.Printf("Tasking %d samples failed: %s\n", len(batch), err)
+			state = taskFailed
+		} else {
+			info.Printf("Tasked %d samples\n", len(batch))
+		}
+		for _, t := range batch {
+			logC <- t.input.annotate(newEvent(t.name, 200, t.task.PrimaryURI, state))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case t, ok := <-taskC:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, t)
+			if len(batch) >= options.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
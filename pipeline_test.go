@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logStates returns all tasking states logged for every sample in order
+func logStates(t *testing.T, path string) map[string][]string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n")[1:] {
+		parts := strings.Split(line, "\t")
+		if len(parts) < 4 {
+			t.Fatalf("log line %q has no tasking state", line)
+		}
+		states[parts[0]] = append(states[parts[0]], parts[3])
+	}
+	return states
+}
+
+func tasksByFilename(g *fakeGateway) map[string]Task {
+	tasks := map[string]Task{}
+	for _, task := range g.Tasks() {
+		tasks[task.Filename] = task
+	}
+	return tasks
+}
+
+func TestPipeline(t *testing.T) {
+	g := newFakeGateway(t)
+	dir := setupRun(t, g)
+	a := writeFile(t, "samples/a.exe", "aaa")
+	b := writeFile(t, "samples/b.exe", "bbb")
+	c := writeFile(t, "samples/c.exe", "ccc")
+	writeFile(t, "samples/a.exe.meta.json", `{"name": "dropper.exe", "source": "sidecar", "tags": ["from-sidecar"]}`)
+	options.Directory = pathList{filepath.Join(dir, "samples")}
+	options.Sidecars = true
+	options.Source = "src"
+	options.Comment = "comment"
+	options.TagsStr = `["tag1"]`
+	options.Pipeline = true
+	options.Tasks = `{"PEINFO": []}`
+	options.BatchSize = 2
+
+	start := time.Now()
+	runUpload(t)
+	// the last batch is sent when the run closes, not on the next tick
+	if took := time.Since(start); took >= pipelineFlushInterval {
+		t.Errorf("the run took %s, want the last batch to be sent right away", took)
+	}
+
+	batches := g.Batches()
+	sort.Ints(batches)
+	if !reflect.DeepEqual(batches, []int{1, 2}) {
+		t.Errorf("tasked in batches of %v, want 2 and 1", batches)
+	}
+
+	tasks := tasksByFilename(g)
+	if len(tasks) != 3 {
+		t.Fatalf("tasked %v, want all three samples", tasks)
+	}
+	// the task carries the metadata of the upload
+	want := Task{
+		PrimaryURI: sha256sum("aaa"),
+		Filename:   "dropper.exe",
+		Tasks:      map[string][]string{"PEINFO": {}},
+		Tags:       []string{"tag1", "from-sidecar"},
+		Source:     "sidecar",
+		Comment:    "comment",
+		Download:   true,
+	}
+	if !reflect.DeepEqual(tasks["dropper.exe"], want) {
+		t.Errorf("task of a.exe = %+v, want %+v", tasks["dropper.exe"], want)
+	}
+	if task := tasks["b.exe"]; task.Source != "src" || !reflect.DeepEqual(task.Tags, []string{"tag1"}) || task.PrimaryURI != sha256sum("bbb") {
+		t.Errorf("task of b.exe = %+v, want the settings of the input", task)
+	}
+
+	states := logStates(t, logFile.Name())
+	for _, sample := range []string{a, b, c} {
+		if !reflect.DeepEqual(states[sample], []string{taskPending, taskDone}) {
+			t.Errorf("%s logged as %v, want pending and then tasked", sample, states[sample])
+		}
+	}
+}
+
+func TestPipelineResume(t *testing.T) {
+	g := newFakeGateway(t)
+	setupRun(t, g)
+	a := writeFile(t, "a.exe", "aaa")
+	b := writeFile(t, "b.exe", "bbb")
+	writeFile(t, "a.exe.meta.json", `{"tags": ["from-sidecar"]}`)
+	writeFile(t, "b.exe.meta.json", `{"tags": ["from-sidecar"]}`)
+	options.FPath = pathList{writeFile(t, "list", a+"\n"+b+"\n")}
+	options.Sidecars = true
+	options.Source = "src"
+	options.Pipeline = true
+	options.Tasks = `{"PEINFO": []}`
+	options.BatchSize = 1
+	g.script("task", fakeResponse{Status: 200}, fakeResponse{Status: 500, Body: "totem is down"})
+
+	runUpload(t)
+	firstLog := logFile.Name()
+	states := logStates(t, firstLog)
+	failed, tasked := a, b
+	if states[a][1] == taskDone {
+		failed, tasked = b, a
+	}
+	if !reflect.DeepEqual(states[failed], []string{taskPending, taskFailed}) || !reflect.DeepEqual(states[tasked], []string{taskPending, taskDone}) {
+		t.Fatalf("log = %v, want one sample tasked and one failed", states)
+	}
+
+	// resuming tasks the failed sample again without uploading it
+	uploads, before := len(g.Uploads()), len(g.Tasks())
+	options = Options{Password: "test"}
+	resumeLog = firstLog
+	runUpload(t)
+
+	if len(g.Uploads()) != uploads {
+		t.Errorf("resuming uploaded %d samples again", len(g.Uploads())-uploads)
+	}
+	retasked := g.Tasks()[before:]
+	want := Task{
+		PrimaryURI: sha256sum(map[string]string{a: "aaa", b: "bbb"}[failed]),
+		Filename:   filepath.Base(failed),
+		Tasks:      map[string][]string{"PEINFO": {}},
+		Tags:       []string{"from-sidecar"},
+		Source:     "src",
+		Download:   true,
+	}
+	if len(retasked) != 1 || !reflect.DeepEqual(retasked[0], want) {
+		t.Errorf("resuming tasked %+v, want only %+v", retasked, want)
+	}
+
+	states = logStates(t, logFile.Name())
+	if !reflect.DeepEqual(states[failed], []string{taskPending, taskDone}) || !reflect.DeepEqual(states[tasked], []string{taskDone}) {
+		t.Errorf("log = %v, want %s tasked again and %s skipped", states, failed, tasked)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Toolbox/holmes"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// setupRun resets all the globals of an upload to the defaults of the flags,
+// points them to the fake gateway and changes into a temporary directory,
+// which is returned
+func setupRun(t *testing.T, g *fakeGateway) string {
+	var out io.Writer = ioutil.Discard
+	if testing.Verbose() {
+		out = os.Stderr
+	}
+	warning = log.New(out, "[WARNING] ", log.Ltime|log.Lshortfile)
+	info = log.New(out, "[INFO] ", log.Ltime)
+	debug = log.New(out, "[DEBUG] ", log.Ltime|log.Lshortfile)
+
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(cwd) })
+
+	options = Options{
+		GatewayURI:    g.URL,
+		Username:      "test",
+		Password:      "test",
+		TagsStr:       "[]",
+		SidecarSuffix: ".meta.json",
+		DateFrom:      "now",
+		DateLayout:    "2006-01-02",
+		BatchSize:     50,
+		ObjectType:    objectFile,
+	}
+	numWorkers = 2
+	resumeLog, resume, processed = "", false, nil
+	tags = nil
+	wg = sync.WaitGroup{}
+	report = &runReport{StatusCodes: map[string]int{}, ErrorClasses: map[string]int{}, MIMETypes: map[string]int{}}
+	sinks, metaMapping, pathTagTemplates = nil, nil, nil
+	dryRun, reportPath, publisher = false, "", nil
+	taskC, pipelineTasks = nil, nil
+	plan, planByMIME, planBySrc, planSkipped = nil, map[string]*planTotal{}, map[string]*planTotal{}, 0
+	return dir
+}
+
+// runUpload uploads like main does, after the flags were parsed
+func runUpload(t *testing.T) map[string]string {
+	loadResumeLog()
+	initLogger()
+	if err := json.Unmarshal([]byte(options.TagsStr), &tags); err != nil {
+		t.Fatal(err)
+	}
+	setupClient()
+	main_upload()
+	return readLog(t, logFile.Name())
+}
+
+// readLog returns the last code logged for every sample
+func readLog(t *testing.T, path string) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	codes := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // options
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), "\t")
+		codes[parts[0]] = strings.Join(parts[1:], "\t")
+	}
+	return codes
+}
+
+func writeFile(t *testing.T, path, content string) string {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	abs, _ := filepath.Abs(path)
+	return abs
+}
+
+// countMIMETypes returns the number of samples in the mime-type distribution
+// of the report
+func countMIMETypes() int {
+	n := 0
+	for _, count := range report.MIMETypes {
+		n += count
+	}
+	return n
+}
+
+func uploadedNames(g *fakeGateway) []string {
+	names := []string{}
+	for _, u := range g.Uploads() {
+		names = append(names, u.Fields.Get("name"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestUploadDirectory(t *testing.T) {
+	g := newFakeGateway(t)
+	dir := setupRun(t, g)
+	a := writeFile(t, "samples/a.exe", "aaa")
+	b := writeFile(t, "samples/emotet/b.exe", "bbb")
+	writeFile(t, "samples/a.exe.meta.json", `{"tags": ["from-sidecar"]}`)
+	options.Directory = pathList{filepath.Join(dir, "samples")}
+	options.Recursive = true
+	options.Sidecars = true
+	options.Source = "src"
+	options.Comment = "comment"
+	options.TagsStr = `["tag1"]`
+
+	codes := runUpload(t)
+
+	if names := uploadedNames(g); !reflect.DeepEqual(names, []string{"a.exe", "b.exe"}) {
+		t.Fatalf("uploaded %v, want a.exe and b.exe", names)
+	}
+	if codes[a] != "200" || codes[b] != "200" {
+		t.Errorf("log = %v, want 200 for both samples", codes)
+	}
+	if n := countMIMETypes(); n != 2 {
+		t.Errorf("report has %d mime-types %v, want one per sample", n, report.MIMETypes)
+	}
+
+	u, _ := g.upload("a.exe")
+	if string(u.Content) != "aaa" || u.Filename != "a.exe" {
+		t.Errorf("content %q of %q, want \"aaa\" of a.exe", u.Content, u.Filename)
+	}
+	for field, want := range map[string][]string{
+		"source":  {"src"},
+		"comment": {"comment"},
+		"tags":    {"tag1", "from-sidecar"},
+		"path":    {"a.exe"},
+	} {
+		if got := u.Fields[field]; !reflect.DeepEqual(got, want) {
+			t.Errorf("field %s = %v, want %v", field, got, want)
+		}
+	}
+	if u, _ := g.upload("b.exe"); u.Fields.Get("path") != "emotet/b.exe" {
+		t.Errorf("path of b.exe = %q, want emotet/b.exe", u.Fields.Get("path"))
+	}
+}
+
+func TestUploadFileList(t *testing.T) {
+	g := newFakeGateway(t)
+	setupRun(t, g)
+	a := writeFile(t, "a.exe", "aaa")
+	b := writeFile(t, "b.exe", "bbb")
+	options.FPath = pathList{writeFile(t, "list", a+"\n"+b+"\n/does/not/exist\n")}
+	g.scriptSample("b.exe", fakeResponse{Status: 500, Body: "storage is down"})
+
+	codes := runUpload(t)
+
+	want := map[string]string{a: "200", b: "500", "/does/not/exist": "0"}
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("log = %v, want %v", codes, want)
+	}
+	if report.ErrorClasses[errHTTP] != 1 || report.ErrorClasses[errSource] != 1 || report.Succeeded != 1 {
+		t.Errorf("report counts %d succeeded, errors %v", report.Succeeded, report.ErrorClasses)
+	}
+	// both samples that could be opened are typed, even without a walk
+	if n := countMIMETypes(); n != 2 {
+		t.Errorf("report has %d mime-types %v, want one per opened sample", n, report.MIMETypes)
+	}
+	for _, f := range report.Failures {
+		if f.Name == b && f.Body != "storage is down" {
+			t.Errorf("response of failed upload = %q", f.Body)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	g := newFakeGateway(t)
+	setupRun(t, g)
+	a := writeFile(t, "a.exe", "aaa")
+	b := writeFile(t, "b.exe", "bbb")
+	options.FPath = pathList{writeFile(t, "list", a+"\n"+b+"\n")}
+	g.scriptSample("b.exe", fakeResponse{Status: 500})
+	options.CritsAPIKey, options.S3SecretKey = "crits-secret", "s3-secret"
+	runUpload(t)
+	firstLog := logFile.Name()
+
+	f, err := os.Open(firstLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := map[string]interface{}{}
+	err = json.NewDecoder(f).Decode(&saved)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"Password", "CritsAPIKey", "S3SecretKey"} {
+		if _, ok := saved[secret]; ok {
+			t.Errorf("%s is saved to the log-file", secret)
+		}
+	}
+
+	// the second run takes all options from the log, except for the secrets,
+	// which are given again
+	g.scriptSample("b.exe", fakeResponse{Status: 200})
+	before := len(g.Uploads())
+	options = Options{Password: "test"}
+	resumeLog = firstLog
+	codes := runUpload(t)
+	if options.Password != "test" || options.GatewayURI != g.URL {
+		t.Errorf("resumed with password %q and gateway %q", options.Password, options.GatewayURI)
+	}
+
+	if logFile.Name() == firstLog {
+		t.Fatal("the resumed run overwrote its log-file")
+	}
+	uploads := g.Uploads()[before:]
+	if len(uploads) != 1 || uploads[0].Fields.Get("name") != "b.exe" {
+		t.Errorf("resuming uploaded %d samples, want only b.exe", len(uploads))
+	}
+	if codes[a] != "200" || codes[b] != "200" {
+		t.Errorf("log = %v, want 200 for both samples", codes)
+	}
+	if report.Skipped != 1 {
+		t.Errorf("%d samples skipped, want 1", report.Skipped)
+	}
+}
+
+func TestTasking(t *testing.T) {
+	g := newFakeGateway(t)
+	setupRun(t, g)
+	options.Tasking = true
+	options.Comment = "comment"
+	options.Tasks = `{"PEINFO": [], "YARA": []}`
+	options.FPath = pathList{writeFile(t, "list", "aaaa a.exe src1\nbbbb b.exe src2\n")}
+	tags = []string{"tag1"}
+	setupClient()
+
+	main_tasking()
+
+	got := g.Tasks()
+	if len(got) != 2 {
+		t.Fatalf("gateway got %d tasks, want 2", len(got))
+	}
+	want := Task{
+		PrimaryURI: "bbbb",
+		Filename:   "b.exe",
+		Source:     "src2",
+		Tasks:      map[string][]string{"PEINFO": {}, "YARA": {}},
+		Tags:       []string{"tag1"},
+		Comment:    "comment",
+		Download:   true,
+	}
+	if !reflect.DeepEqual(got[1], want) {
+		t.Errorf("task = %+v, want %+v", got[1], want)
+	}
+
+	g.script("task", fakeResponse{Body: "unknown service"})
+	err := submitTasks(got)
+	var taskErr *holmes.TaskError
+	if !errors.As(err, &taskErr) || taskErr.Message != "unknown service" {
+		t.Errorf("rejected tasking returned %v, want a TaskError", err)
+	}
+}
+
+// newFakeCrits serves the CRITs API with a single sample with the given md5,
+// and a CRITs file server under /files/
+func newFakeCrits(t *testing.T, md5 string) *httptest.Server {
+	crits := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/files/5f1e2d3c4b5a69788796a5b4" {
+			w.Write([]byte("from the file server"))
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("username") != "analyst" || q.Get("api_key") != "key" {
+			w.WriteHeader(401)
+			return
+		}
+		switch {
+		case r.URL.Path == "/api/v1/samples/" && q.Get("c-md5") == md5:
+			w.Write([]byte(`{"objects": [{"_id": "5f1e2d3c4b5a69788796a5b4", "filename": "invoice.exe", "md5": "` + md5 + `",
+				"source": [{"name": "mail"}], "campaign": [{"name": "apt1"}], "bucket_list": ["phishing"]}]}`))
+		case r.URL.Path == "/api/v1/samples/5f1e2d3c4b5a69788796a5b4/" && q.Get("file") == "1":
+			w.Write([]byte("from crits"))
+		default:
+			w.Write([]byte(`{"objects": []}`))
+		}
+	}))
+	t.Cleanup(crits.Close)
+	return crits
+}
+
+func TestCritsFallback(t *testing.T) {
+	md5 := "0123456789abcdef0123456789abcdef"
+	crits := newFakeCrits(t, md5)
+
+	// the API alone, then the API for the metadata and "-cfs" for the content
+	for _, fileServer := range []string{"", crits.URL + "/files"} {
+		g := newFakeGateway(t)
+		setupRun(t, g)
+		options.CritsURI = crits.URL
+		options.CritsUser = "analyst"
+		options.CritsAPIKey = "key"
+		options.CritsFileServer = fileServer
+		options.FPath = pathList{writeFile(t, "list", md5+"\n")}
+
+		codes := runUpload(t)
+
+		if codes[md5] != "200" {
+			t.Fatalf("cfs %q: log = %v, want 200 for %s", fileServer, codes, md5)
+		}
+		u, ok := g.upload("invoice.exe")
+		if !ok {
+			t.Fatalf("cfs %q: uploaded %v, want invoice.exe", fileServer, uploadedNames(g))
+		}
+		want := "from crits"
+		if fileServer != "" {
+			want = "from the file server"
+		}
+		if string(u.Content) != want || u.Fields.Get("source") != "mail" {
+			t.Errorf("cfs %q: uploaded %q from source %q", fileServer, u.Content, u.Fields.Get("source"))
+		}
+		if want := []string{"crits-source:mail", "campaign:apt1", "phishing"}; !reflect.DeepEqual(u.Fields["tags"], want) {
+			t.Errorf("cfs %q: tags = %v, want %v", fileServer, u.Fields["tags"], want)
+		}
+	}
+}
+
+func TestCritsFileServer(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	options.CritsFileServer = newFakeCrits(t, "").URL + "/files"
+
+	// without the API, the name is a bson document with the CRITs ID
+	id, err := bson.Marshal(critsSample{Id: bson.ObjectIdHex("5f1e2d3c4b5a69788796a5b4")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := openSample(string(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	content, _ := ioutil.ReadAll(r)
+	if string(content) != "from the file server" {
+		t.Errorf("downloaded %q", content)
+	}
+
+	if _, _, err := openSample("0123456789abcdef0123456789abcdef"); err == nil {
+		t.Error("a hash can be fetched from the file server without the API")
+	}
+}
+
+func TestUploadTimeout(t *testing.T) {
+	g := newFakeGateway(t)
+	setupRun(t, g)
+	a := writeFile(t, "a.exe", "aaa")
+	options.FPath = pathList{writeFile(t, "list", a+"\n")}
+	options.HeaderTimeout = 100 * time.Millisecond
+	g.scriptSample("a.exe", fakeResponse{Latency: 10 * time.Second})
+
+	codes := runUpload(t)
+
+	if codes[a] != "0" || report.ErrorClasses[errTimeout] != 1 {
+		t.Errorf("log = %v, errors %v, want a timeout", codes, report.ErrorClasses)
+	}
+}
+
+func TestUploadTarStream(t *testing.T) {
+	g := newFakeGateway(t)
+	setupRun(t, g)
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range []struct {
+		name, content string
+		pax           map[string]string
+	}{
+		{"carved/a.exe", "aaa", map[string]string{paxSource: "pcap", paxTags: `["http"]`}},
+		{"b.exe", "bbb", nil},
+	} {
+		err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), PAXRecords: e.pax, Format: tar.FormatPAX})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.content))
+	}
+	tw.Close()
+	options.Stream = writeFile(t, "samples.tar", buf.String())
+	options.StreamFormat = "tar"
+	options.Source = "default"
+
+	codes := runUpload(t)
+
+	if codes["stream:1/carved/a.exe"] != "200" || codes["stream:2/b.exe"] != "200" {
+		t.Errorf("log = %v, want 200 for both entries", codes)
+	}
+	u, ok := g.upload("a.exe")
+	if !ok || string(u.Content) != "aaa" {
+		t.Fatalf("uploaded %v, want a.exe with its content", uploadedNames(g))
+	}
+	if u.Fields.Get("source") != "pcap" || u.Fields.Get("path") != "carved/a.exe" || !reflect.DeepEqual(u.Fields["tags"], []string{"http"}) {
+		t.Errorf("fields of a.exe = %v", u.Fields)
+	}
+	if u, _ := g.upload("b.exe"); u.Fields.Get("source") != "default" {
+		t.Errorf("source of b.exe = %q, want the one of -src", u.Fields.Get("source"))
+	}
+	if len(streamEntries) != 0 {
+		t.Errorf("%d entries are still kept in memory", len(streamEntries))
+	}
+}
+
+func TestUploadRecordStream(t *testing.T) {
+	g := newFakeGateway(t)
+	setupRun(t, g)
+	stream := `{"name": "a.exe", "size": 3, "tags": ["quarantine"], "comment": "decrypted"}` + "\naaa" +
+		`{"name": "a.exe", "size": 4}` + "\nabcd"
+	options.Stream = writeFile(t, "records", stream)
+	options.StreamFormat = "records"
+	numWorkers = 1
+	g.script("samples", fakeResponse{Status: 200}, fakeResponse{Status: 500})
+
+	codes := runUpload(t)
+
+	if len(g.Uploads()) != 2 || codes["stream:1/a.exe"] != "200" || codes["stream:2/a.exe"] != "500" {
+		t.Fatalf("uploaded %v, log = %v, want both records", uploadedNames(g), codes)
+	}
+	contents := []string{}
+	for _, u := range g.Uploads() {
+		contents = append(contents, string(u.Content))
+		if u.Fields.Get("comment") == "decrypted" && !reflect.DeepEqual(u.Fields["tags"], []string{"quarantine"}) {
+			t.Errorf("tags = %v, want the ones of the header", u.Fields["tags"])
+		}
+	}
+	sort.Strings(contents)
+	if !reflect.DeepEqual(contents, []string{"aaa", "abcd"}) {
+		t.Errorf("contents = %v", contents)
+	}
+
+	// the failed record has the same name, but is uploaded again
+	before := len(g.Uploads())
+	options = Options{Password: "test"}
+	resumeLog = logFile.Name()
+	codes = runUpload(t)
+	if uploads := g.Uploads()[before:]; len(uploads) != 1 || string(uploads[0].Content) != "abcd" || codes["stream:2/a.exe"] != "200" {
+		t.Errorf("resuming uploaded %d samples, log = %v, want only the second record", len(uploads), codes)
+	}
+}
+
+// the size of a header is not allocated before the content arrives
+func TestRecordStreamTruncated(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	err := readRecordStream(nil, strings.NewReader(`{"name": "a.exe", "size": 1099511627776}`+"\naaa"))
+	if err == nil || !strings.Contains(err.Error(), "content of a.exe: unexpected EOF") {
+		t.Errorf("readRecordStream = %v, want the truncated content", err)
+	}
+}
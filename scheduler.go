@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// scheduler hands the samples of all inputs to the workers. Every input has
+// a short queue, so an input that is read fast can't push the others back.
+type scheduler struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	inputs []*input
+	limit  int  // samples per queue, pushing more blocks
+	closed bool // no inputs are added anymore
+}
+
+func newScheduler(limit int) *scheduler {
+	if limit < 1 {
+		limit = 1
+	}
+	s := &scheduler{limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// add registers an input, its samples are handed out from now on
+func (s *scheduler) add(in *input) *input {
+	s.mu.Lock()
+	s.inputs = append(s.inputs, in)
+	s.mu.Unlock()
+	return in
+}
+
+// push queues a sample of an input, it blocks while the queue of the input
+// is full
+func (s *scheduler) push(in *input, sample string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(in.queue) >= s.limit {
+		start := time.Now()
+		for len(in.queue) >= s.limit {
+			s.cond.Wait()
+		}
+		recordStage(&report.Stages.QueueWait, time.Since(start))
+	}
+	if len(in.queue) == 0 {
+		// an input that was idle doesn't get to catch up on the samples it
+		// didn't have, it starts with the others of its priority
+		min, active := 0.0, false
+		for _, other := range s.inputs {
+			if other != in && len(other.queue) > 0 && other.Priority == in.Priority && (!active || other.pass < min) {
+				min, active = other.pass, true
+			}
+		}
+		if active && in.pass < min {
+			in.pass = min
+		}
+	}
+	in.queue = append(in.queue, sample)
+	s.cond.Broadcast()
+}
+
+// finish marks an input as complete
+func (s *scheduler) finish(in *input) {
+	s.mu.Lock()
+	in.done = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// close tells the workers that no inputs are added anymore, they stop once
+// all inputs are finished and empty
+func (s *scheduler) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// next returns the sample to work on next and its input: the one with the
+// highest priority, and the lowest pass among those of the same priority.
+// It returns false once there is nothing left.
+func (s *scheduler) next() (*input, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var waited time.Duration
+	defer func() {
+		if waited > 0 {
+			recordStage(&report.Stages.UploadWait, waited)
+		}
+	}()
+	for {
+		var best *input
+		finished := s.closed
+		for _, in := range s.inputs {
+			if !in.done {
+				finished = false
+			}
+			if len(in.queue) == 0 {
+				continue
+			}
+			if best == nil || in.Priority > best.Priority || (in.Priority == best.Priority && in.pass < best.pass) {
+				best = in
+			}
+		}
+		if best != nil {
+			sample := best.queue[0]
+			best.queue = best.queue[1:]
+			best.pass += 1 / float64(best.Weight)
+			s.cond.Broadcast()
+			return best, sample, true
+		}
+		if finished {
+			return nil, "", false
+		}
+		start := time.Now()
+		s.cond.Wait()
+		waited += time.Since(start)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSchedulerOrder(t *testing.T) {
+	inputOverrides = map[string]inputSettings{
+		"bulk":   {Weight: 2},
+		"urgent": {Priority: 1},
+	}
+	defer func() { inputOverrides = nil }()
+
+	s := newScheduler(10)
+	bulk, small, urgent := s.add(newInput("bulk", "")), s.add(newInput("small", "")), s.add(newInput("urgent", ""))
+	for _, sample := range []string{"b1", "b2", "b3", "b4"} {
+		s.push(bulk, sample)
+	}
+	s.push(small, "s1")
+	s.push(small, "s2")
+	s.push(urgent, "u1")
+	s.push(urgent, "u2")
+	for _, in := range []*input{bulk, small, urgent} {
+		s.finish(in)
+	}
+	s.close()
+
+	got := []string{}
+	for _, sample, ok := s.next(); ok; _, sample, ok = s.next() {
+		got = append(got, sample)
+	}
+	// the urgent input goes first, then bulk gets two samples for every one of small
+	want := []string{"u1", "u2", "b1", "s1", "b2", "b3", "s2", "b4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
+
+func TestSchedulerIdleInput(t *testing.T) {
+	s := newScheduler(10)
+	bulk, late := s.add(newInput("bulk", "")), s.add(newInput("late", ""))
+	for _, sample := range []string{"b1", "b2", "b3", "b4"} {
+		s.push(bulk, sample)
+	}
+	s.next()
+	s.next()
+	// late had nothing while bulk was served, it doesn't get all the workers now
+	s.push(late, "l1")
+	s.push(late, "l2")
+	s.finish(bulk)
+	s.finish(late)
+	s.close()
+
+	got := []string{}
+	for _, sample, ok := s.next(); ok; _, sample, ok = s.next() {
+		got = append(got, sample)
+	}
+	want := []string{"b3", "l1", "b4", "l2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// resultEvent is what happened to a single sample. Every event is written to
+// the log-file and handed to the sinks selected with "-sinks".
+type resultEvent struct {
+	Sample    string    `json:"sample"`
+	Code      int       `json:"code"` // 0 if there was no response
+	SHA256    string    `json:"sha256,omitempty"`
+	TaskState string    `json:"task_state,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	ErrClass  string    `json:"error_class,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Skipped   bool      `json:"skipped,omitempty"` // already processed by a previous run
+	Input     string    `json:"input,omitempty"`   // only set if the run has several inputs
+	Time      time.Time `json:"time"`
+}
+
+// newEvent creates the event of a sample, sha256sum and taskState are only
+// set in pipeline mode
+func newEvent(name string, code int, sha256sum, taskState string) resultEvent {
+	return resultEvent{Sample: name, Code: code, SHA256: sha256sum, TaskState: taskState, Time: time.Now()}
+}
+
+// uploadEvent creates the event of an upload
+func uploadEvent(r *uploadResult) resultEvent {
+	e := newEvent(r.Name, r.Code, r.SHA256, "")
+	e.Size = r.Size
+	e.ErrClass = r.ErrClass
+	e.Error = r.Error
+	return e
+}
+
+// skipEvent creates the event of a sample that is not uploaded again
+func skipEvent(name string, sha256sum, taskState string) resultEvent {
+	e := newEvent(name, 200, sha256sum, taskState)
+	e.Skipped = true
+	return e
+}
+
+func (e resultEvent) succeeded() bool {
+	return e.Code == 200 && e.ErrClass == "" && e.TaskState != taskFailed
+}
+
+// resultSink receives the events of all samples, one at a time. Errors are
+// only reported, a sink can't stop an upload.
+type resultSink interface {
+	Send(e resultEvent) error
+	Close() error
+}
+
+var sinks []resultSink
+
+// sinkFlags registers the flags of the sinks, for uploads and mirrors
+func sinkFlags(fs *flag.FlagSet) {
+	fs.StringVar(&options.Sinks, "sinks", "", "Comma separated list of additional outputs for the result of every sample: \"stdout\" (json lines), \"webhook\", \"syslog\" and \"amqp\". The log-file is always written")
+	fs.StringVar(&options.Webhook, "webhook", "", "URL the result of every sample is POSTed to as json, for the \"webhook\" sink")
+	fs.StringVar(&options.SyslogAddr, "syslog", "", "Address of the syslog server for the \"syslog\" sink, e.g. udp://127.0.0.1:514 (default: the local syslog)")
+	fs.StringVar(&options.SinkAMQP, "sink-amqp", "", "URI of the RabbitMQ broker for the \"amqp\" sink (default: \"-amqp\")")
+	fs.StringVar(&options.SinkExchange, "sink-exchange", "holmes_toolbox", "The exchange results are published to by the \"amqp\" sink")
+	fs.StringVar(&options.SinkRoutingKey, "sink-routing-key", "sample.result", "The routing key of results published by the \"amqp\" sink")
+}
+
+// initSinks creates the sinks given by "-sinks"
+func initSinks() {
+	if options.Sinks == "" {
+		return
+	}
+	for _, name := range strings.Split(options.Sinks, ",") {
+		var (
+			s   resultSink
+			err error
+		)
+		switch strings.TrimSpace(name) {
+		case "stdout":
+			// keep stdout for the results
+			info.SetOutput(os.Stderr)
+			debug.SetOutput(os.Stderr)
+			s = &stdoutSink{enc: json.NewEncoder(os.Stdout)}
+		case "webhook":
+			if options.Webhook == "" {
+				warning.Fatal("The \"webhook\" sink needs \"-webhook\"")
+			}
+			s = &webhookSink{uri: options.Webhook}
+		case "syslog":
+			s, err = newSyslogSink(options.SyslogAddr)
+		case "amqp":
+			uri := options.SinkAMQP
+			if uri == "" {
+				uri = options.AMQPURI
+			}
+			if uri == "" {
+				warning.Fatal("The \"amqp\" sink needs \"-sink-amqp\" or \"-amqp\"")
+			}
+			var p *amqpPublisher
+			p, err = newEventPublisher(uri, options.SinkExchange, options.SinkRoutingKey)
+			if err == nil {
+				s = &busSink{publisher: p}
+			}
+		case "":
+			continue
+		default:
+			warning.Fatalf("Unknown sink %q\n", name)
+		}
+		if err != nil {
+			warning.Fatalf("Couldn't set up the %s sink: %s\n", name, err)
+		}
+		sinks = append(sinks, newQueuedSink(s))
+	}
+}
+
+// sendEvent hands an event to all sinks
+func sendEvent(e resultEvent) {
+	for _, s := range sinks {
+		err := s.Send(e)
+		if err != nil {
+			warning.Printf("Couldn't send the result of %s to a sink: %s\n", e.Sample, err)
+		}
+	}
+}
+
+// closeSinks waits until all sinks sent the events queued for them, also
+// after an interrupt
+func closeSinks() {
+	for _, s := range sinks {
+		s.Close()
+	}
+	sinks = nil
+}
+
+// number of events a sink can fall behind, before the logger waits for it
+const sinkQueue = 1000
+
+// queuedSink sends the events to a sink in its own goroutine, so that a slow
+// sink holds up neither the log-file nor the other sinks
+type queuedSink struct {
+	sink   resultSink
+	events chan resultEvent
+	done   chan struct{}
+}
+
+func newQueuedSink(s resultSink) *queuedSink {
+	q := &queuedSink{sink: s, events: make(chan resultEvent, sinkQueue), done: make(chan struct{})}
+	go q.run()
+	return q
+}
+
+func (q *queuedSink) run() {
+	defer close(q.done)
+	for e := range q.events {
+		err := q.sink.Send(e)
+		if err != nil {
+			warning.Printf("Couldn't send the result of %s to a sink: %s\n", e.Sample, err)
+		}
+	}
+}
+
+func (q *queuedSink) Send(e resultEvent) error {
+	q.events <- e
+	return nil
+}
+
+func (q *queuedSink) Close() error {
+	close(q.events)
+	<-q.done
+	return q.sink.Close()
+}
+
+// stdoutSink prints every event as a json line
+type stdoutSink struct {
+	enc *json.Encoder
+}
+
+func (s *stdoutSink) Send(e resultEvent) error {
+	return s.enc.Encode(e)
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
+
+// webhookTimeout limits the delivery of a single event to the webhook
+const webhookTimeout = 30 * time.Second
+
+// webhookSink POSTs every event as json
+type webhookSink struct {
+	uri string
+}
+
+func (s *webhookSink) Send(e resultEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// not aborted by an interrupt, closeSinks still delivers the queued events
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", s.uri, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer SafeResponseClose(resp)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	return nil
+}
+
+// syslogSink writes every event as json, failures with warning priority
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// newSyslogSink connects to addr, given as network://host:port, or to the
+// local syslog if addr is empty
+func newSyslogSink(addr string) (*syslogSink, error) {
+	network, raddr := "", ""
+	if addr != "" {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "holmes-toolbox")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Send(e resultEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if e.succeeded() {
+		return s.w.Info(string(line))
+	}
+	return s.w.Warning(string(line))
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
+
+// busSink publishes every event as its own message. It works with any
+// taskPublisher, the "amqp" sink uses an amqpPublisher.
+type busSink struct {
+	publisher taskPublisher
+}
+
+func (s *busSink) Send(e resultEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.publisher.Publish(body)
+}
+
+func (s *busSink) Close() error {
+	return s.publisher.Close()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookSink(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	setupClient()
+
+	var (
+		mu       sync.Mutex
+		received []string
+	)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		e := resultEvent{}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &e); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %q (%s)", body, r.Header.Get("Content-Type"))
+		}
+		mu.Lock()
+		received = append(received, e.Sample)
+		mu.Unlock()
+		if e.Sample == "b.exe" {
+			w.WriteHeader(500)
+		}
+	}))
+	defer srv.Close()
+
+	options.Sinks, options.Webhook = "webhook", srv.URL
+	initSinks()
+	// the webhook doesn't answer yet, but the logger isn't held up by it
+	start := time.Now()
+	for _, name := range []string{"a.exe", "b.exe", "c.exe"} {
+		sendEvent(newEvent(name, 200, "", ""))
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("sending the events took %s", d)
+	}
+	// an interrupt doesn't drop the queued events
+	ctx, cancel := context.WithCancel(context.Background())
+	saved := rootCtx
+	rootCtx = ctx
+	defer func() { rootCtx = saved }()
+	cancel()
+	close(release)
+	closeSinks()
+
+	// a failed event doesn't stop the ones after it
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"a.exe", "b.exe", "c.exe"}; !reflect.DeepEqual(received, want) {
+		t.Errorf("webhook received %v, want %v", received, want)
+	}
+}
+
+func TestBusSink(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	p := &recordingPublisher{}
+	sinks = []resultSink{newQueuedSink(&busSink{publisher: p})}
+
+	sendEvent(newEvent("a.exe", 200, "aaaa", ""))
+	sendEvent(skipEvent("b.exe", "bbbb", ""))
+	closeSinks()
+
+	if len(p.bodies) != 2 {
+		t.Fatalf("published %d events, want 2", len(p.bodies))
+	}
+	events := make([]resultEvent, len(p.bodies))
+	for i, body := range p.bodies {
+		if err := json.Unmarshal(body, &events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if events[0].Sample != "a.exe" || events[0].SHA256 != "aaaa" || events[1].Sample != "b.exe" || !events[1].Skipped {
+		t.Errorf("published %+v", events)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// smokeDeliveries queues a delivery for every body, settled with acker
+func smokeDeliveries(acker *fakeAcknowledger, bodies ...string) chan amqp.Delivery {
+	deliveries := make(chan amqp.Delivery, len(bodies))
+	for i, body := range bodies {
+		deliveries <- amqp.Delivery{Acknowledger: acker, DeliveryTag: uint64(i + 1), Body: []byte(body)}
+	}
+	return deliveries
+}
+
+func TestSmokeTasks(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	objects := []smokeObject{
+		{"2001:4860:4860::8888", "ip"},
+		{"mail.google.com", "domain"},
+		{"0a4efbe854f1fa444303ca210842e779b55570216f62a4a406c89c564dabaf97", "file"},
+		{"example.org", "mutex"},
+	}
+	tasksByType := map[string]map[string][]string{
+		"ip":     {"asnmeta": {}},
+		"domain": {"DNSMETA": {}},
+		"file":   {"PEINFO": {}, "YARA": {}},
+	}
+	allTasks, states, objectTypes := smokeTasks(objects, tasksByType, []string{"test"}, "http://storage:8016/samples/")
+
+	hash := objects[2].Value
+	want := []Task{
+		{PrimaryURI: objects[0].Value, SecondaryURI: objects[0].Value, Filename: objects[0].Value, Tasks: tasksByType["ip"], Tags: []string{"test"}},
+		{PrimaryURI: objects[1].Value, SecondaryURI: objects[1].Value, Filename: objects[1].Value, Tasks: tasksByType["domain"], Tags: []string{"test"}},
+		{PrimaryURI: "http://storage:8016/samples/" + hash, SecondaryURI: "http://storage:8016/samples/" + hash, Filename: hash, Tasks: tasksByType["file"], Tags: []string{"test"}, Download: true},
+	}
+	if !reflect.DeepEqual(allTasks, want) {
+		t.Errorf("tasks = %+v, want %+v", allTasks, want)
+	}
+
+	wantStates := map[string]map[string]string{
+		objects[0].Value: {"ASNMETA": smokeMissing},
+		objects[1].Value: {"DNSMETA": smokeMissing},
+		hash:             {"PEINFO": smokeMissing, "YARA": smokeMissing},
+	}
+	if !reflect.DeepEqual(states, wantStates) {
+		t.Errorf("states = %v, want %v", states, wantStates)
+	}
+	if objectTypes[objects[0].Value] != "ip" || objectTypes[hash] != "file" || objectTypes["example.org"] != "" {
+		t.Errorf("object types = %v, want the unknown type to be skipped", objectTypes)
+	}
+}
+
+func TestPublishSmoke(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	channel := &fakeChannel{ack: true, routed: true}
+	p := &amqpPublisher{
+		channel:   channel,
+		confirms:  make(chan amqp.Confirmation, 1),
+		returns:   make(chan amqp.Return, 1),
+		mandatory: true,
+	}
+	channel.p = p
+
+	allTasks, _, _ := smokeTasks(defaultSmokeObjects, map[string]map[string][]string{
+		"ip": {"ASNMETA": {}}, "domain": {"DNSMETA": {}}, "file": {"PEINFO": {}},
+	}, []string{"test"}, "")
+	if err := publishSmoke(p, allTasks); err != nil {
+		t.Fatal(err)
+	}
+	if len(channel.sent) != len(defaultSmokeObjects) {
+		t.Fatalf("published %d messages, want one per object", len(channel.sent))
+	}
+	for i, msg := range channel.sent {
+		var got Task
+		if err := json.Unmarshal(msg.Body, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, allTasks[i]) {
+			t.Errorf("message %d = %+v, want %+v", i, got, allTasks[i])
+		}
+	}
+
+	channel.routed = false
+	if err := publishSmoke(p, allTasks); err == nil || !strings.Contains(err.Error(), "Publishing 8.8.8.8 failed") {
+		t.Errorf("publishSmoke = %v, want the task that could not be routed", err)
+	}
+}
+
+func TestCollectSmoke(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	hash := "0a4efbe854f1fa444303ca210842e779b55570216f62a4a406c89c564dabaf97"
+	states := map[string]map[string]string{
+		"8.8.8.8":         {"ASNMETA": smokeMissing},
+		"mail.google.com": {"DNSMETA": smokeMissing},
+		hash:              {"PEINFO": smokeMissing, "YARA": smokeMissing, "OBJDUMP": smokeMissing},
+	}
+
+	resultAcker := &fakeAcknowledger{}
+	results := smokeDeliveries(resultAcker,
+		`{"filename":"8.8.8.8","service_name":"asnmeta","data":"{\"asn\":15169}"}`,
+		`{"filename":"mail.google.com","service_name":"dnsmeta","data":"{\"error\":\"timeout\"}"}`,
+		`{"sha256":"`+hash+`","service_name":"peinfo","data":"{}"}`,
+		`{"filename":"1.1.1.1","service_name":"asnmeta","data":"{}"}`, // another run
+		`not json`,
+	)
+	errAcker := &fakeAcknowledger{}
+	failures := smokeDeliveries(errAcker,
+		`{"filename":"`+hash+`","tasks":{"YARA":[]}}`,
+		`{`,
+	)
+	close(failures)
+
+	err := collectSmoke(states, &resultConsumer{deliveries: results}, &resultConsumer{deliveries: failures}, time.After(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]string{
+		"8.8.8.8":         {"ASNMETA": smokeResult},
+		"mail.google.com": {"DNSMETA": smokeError},
+		hash:              {"PEINFO": smokeResult, "YARA": smokeError, "OBJDUMP": smokeMissing},
+	}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+	if !reflect.DeepEqual(resultAcker.acked, []uint64{1, 2, 3, 4}) || !reflect.DeepEqual(resultAcker.rejected, []uint64{5}) || resultAcker.requeued != nil {
+		t.Errorf("results: acked %v, rejected %v and requeued %v", resultAcker.acked, resultAcker.rejected, resultAcker.requeued)
+	}
+	if !reflect.DeepEqual(errAcker.acked, []uint64{1}) || !reflect.DeepEqual(errAcker.rejected, []uint64{2}) || errAcker.requeued != nil {
+		t.Errorf("failed tasks: acked %v, rejected %v and requeued %v", errAcker.acked, errAcker.rejected, errAcker.requeued)
+	}
+
+	out := &bytes.Buffer{}
+	printSmokeReport(out, states, map[string]string{"8.8.8.8": "ip", "mail.google.com": "domain", hash: "file"})
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	wantLines := [][]string{
+		{"SERVICE", "TYPE", "OBJECT", "STATUS"},
+		{"OBJDUMP", "file", hash, "nothing"},
+		{"PEINFO", "file", hash, "result"},
+		{"YARA", "file", hash, "error"},
+		{"ASNMETA", "ip", "8.8.8.8", "result"},
+		{"DNSMETA", "domain", "mail.google.com", "error"},
+	}
+	if len(lines) != len(wantLines) {
+		t.Fatalf("report = %q, want %d lines", out, len(wantLines))
+	}
+	for i, line := range lines {
+		if fields := strings.Fields(line); !reflect.DeepEqual(fields, wantLines[i]) {
+			t.Errorf("line %d of the report = %q, want %q", i, fields, wantLines[i])
+		}
+	}
+}
+
+func TestCollectSmokeLostConnection(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	states := map[string]map[string]string{"8.8.8.8": {"ASNMETA": smokeMissing}}
+	results := smokeDeliveries(&fakeAcknowledger{})
+	close(results)
+
+	err := collectSmoke(states, &resultConsumer{deliveries: results}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "Lost connection") {
+		t.Errorf("collectSmoke = %v, want the lost connection", err)
+	}
+}
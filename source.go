@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SampleSource fetches the content of a sample. Sources are selected by the
+// URI scheme of a line in the sample list, lines without a known scheme are
+// looked up locally and on the CRITs file server.
+type SampleSource interface {
+	// Open returns the content of the sample and the filename to upload it with
+	Open(u *url.URL) (io.ReadCloser, string, error)
+}
+
+// sampleMeta is what a source knows about a sample besides its content
+type sampleMeta struct {
+	Name    string
+	Source  string
+	Comment string
+	Tags    []string
+	Date    time.Time
+	Path    string // relative to "-dir"
+}
+
+// metadataReader is implemented by the readers of sources, which know more
+// about a sample than its name
+type metadataReader interface {
+	Metadata() sampleMeta
+}
+
+// sampleFile attaches metadata to the content of a sample
+type sampleFile struct {
+	io.ReadCloser
+	meta sampleMeta
+}
+
+func (f *sampleFile) Metadata() sampleMeta {
+	return f.meta
+}
+
+// sampleSources maps URI schemes to their source, it is filled by initSources
+var sampleSources = map[string]SampleSource{}
+
+func initSources() {
+	sampleSources["file"] = localSource{}
+	sampleSources["crits"] = critsSource{}
+	sampleSources["http"] = httpSource{}
+	sampleSources["https"] = httpSource{}
+	sampleSources["s3"] = &s3Source{
+		Endpoint:  options.S3Endpoint,
+		Region:    options.S3Region,
+		AccessKey: options.S3AccessKey,
+		SecretKey: options.S3SecretKey,
+	}
+	sampleSources["sftp"] = &sshSource{}
+	sampleSources["scp"] = &sshSource{scp: true}
+	sampleSources["holmes"] = holmesSource{}
+	sampleSources["stream"] = streamSource{}
+	sampleSources["pcap"] = streamSource{}
+	sampleSources["mail"] = streamSource{}
+
+	if options.HTTPSources != "" {
+		templates := map[string]string{}
+		err := json.Unmarshal([]byte(options.HTTPSources), &templates)
+		if err != nil {
+			warning.Fatal("Error while parsing list of http sources! ", err)
+		}
+		for scheme, template := range templates {
+			if _, taken := sampleSources[scheme]; taken {
+				warning.Fatalf("The http source %s shadows a builtin source", scheme)
+			}
+			sampleSources[scheme] = httpTemplateSource(template)
+		}
+	}
+}
+
+// openSample returns the content of the sample referenced by a line of the
+// sample list or a file found in the directory, together with its filename.
+func openSample(name string) (io.ReadCloser, string, error) {
+	u, err := url.Parse(name)
+	if err == nil && u.Scheme != "" {
+		if source, ok := sampleSources[strings.ToLower(u.Scheme)]; ok {
+			debug.Printf("Fetching %s from %s source\n", name, u.Scheme)
+			return source.Open(u)
+		}
+	}
+
+	// check if local file
+	r, err := os.Open(name)
+	if err == nil {
+		return r, filepath.Base(name), nil
+	}
+	if options.CritsFileServer == "" && options.CritsURI == "" {
+		return nil, "", err
+	}
+
+	debug.Println("Found non local file", name)
+	return critsSource{}.Open(&url.URL{Scheme: "crits", Opaque: name})
+}
+
+// localSource reads file:// URIs
+type localSource struct{}
+
+func (localSource) Open(u *url.URL) (io.ReadCloser, string, error) {
+	r, err := os.Open(u.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	return r, filepath.Base(u.Path), nil
+}
+
+// critsSource downloads samples from CRITs, e.g. crits:<md5>. If the CRITs
+// API is specified, hashes are resolved through it and the sample keeps its
+// real filename, source, campaigns and bucket list. Otherwise only CRITs IDs
+// can be fetched from the CRITs file server.
+type critsSource struct{}
+
+func (critsSource) Open(u *url.URL) (io.ReadCloser, string, error) {
+	hash := u.Opaque
+	if hash == "" {
+		hash = strings.TrimPrefix(u.Host+u.Path, "/")
+	}
+
+	if options.CritsURI != "" {
+		c := &critsClient{BaseURI: options.CritsURI, Username: options.CritsUser, APIKey: options.CritsAPIKey}
+		obj, err := c.Lookup(hash)
+		if err != nil {
+			return nil, "", err
+		}
+		r, err := c.Download(obj)
+		if err != nil {
+			return nil, "", err
+		}
+		meta := obj.metadata()
+		if meta.Name == "" {
+			meta.Name = hash
+		}
+		return &sampleFile{ReadCloser: r, meta: meta}, meta.Name, nil
+	}
+
+	if options.CritsFileServer == "" {
+		return nil, "", errors.New("no CRITs file server specified")
+	}
+
+	// try to get file from crits file server
+	cId := &critsSample{}
+	if err := bson.Unmarshal([]byte(hash), cId); err != nil {
+		return nil, "", err
+	}
+	rawId := cId.Id.Hex()
+
+	// without the API, the real name is only known if the file server sends it
+	return download(options.CritsFileServer+"/"+rawId, hash)
+}
+
+// httpSource downloads http:// and https:// URIs
+type httpSource struct{}
+
+func (httpSource) Open(u *url.URL) (io.ReadCloser, string, error) {
+	return download(u.String(), path.Base(u.Path))
+}
+
+// httpTemplateSource downloads a sample by its hash from a URL template,
+// where {hash} is replaced, e.g. a line "vs:<sha256>" for the template
+// "https://repo.example/samples/{hash}" registered as "vs"
+type httpTemplateSource string
+
+func (t httpTemplateSource) Open(u *url.URL) (io.ReadCloser, string, error) {
+	hash := u.Opaque
+	if hash == "" {
+		hash = strings.TrimPrefix(u.Host+u.Path, "/")
+	}
+	return download(strings.Replace(string(t), "{hash}", url.PathEscape(hash), -1), hash)
+}
+
+// download fetches uri with the global client. The filename is taken from the
+// Content-Disposition header, if the server sends one.
+func download(uri, name string) (io.ReadCloser, string, error) {
+	req, err := http.NewRequestWithContext(rootCtx, "GET", uri, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// return if file does not exist
+	if resp.StatusCode != 200 {
+		SafeResponseClose(resp)
+		return nil, "", fmt.Errorf("Couldn't download file (%d)", resp.StatusCode)
+	}
+
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = filepath.Base(params["filename"])
+	}
+	return resp.Body, name, nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshSource downloads sftp://user@host/path and scp://user@host/path URIs.
+// Connections are kept open and shared between the workers. Transfers are
+// aborted, when the run is interrupted.
+type sshSource struct {
+	scp bool
+
+	mu      sync.Mutex
+	clients map[string]*ssh.Client
+}
+
+func (s *sshSource) Open(u *url.URL) (io.ReadCloser, string, error) {
+	conn, err := s.connect(u)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if s.scp {
+		session, err := conn.NewSession()
+		if err != nil {
+			s.drop(conn)
+			return nil, "", err
+		}
+		return scpFetch(session, u.Path)
+	}
+
+	sc, err := sftp.NewClient(conn)
+	if err != nil {
+		s.drop(conn)
+		return nil, "", err
+	}
+	stop := closeOnCancel(sc)
+	f, err := sc.Open(u.Path)
+	if err != nil {
+		stop()
+		sc.Close()
+		return nil, "", cancelledErr(err)
+	}
+	return &sftpFile{File: f, client: sc, stop: stop}, path.Base(u.Path), nil
+}
+
+// cancelledErr replaces the error of a transfer, that was aborted because
+// the run was interrupted. Closing a transfer may look like its regular end.
+func cancelledErr(err error) error {
+	if err != nil && cancelled() {
+		return rootCtx.Err()
+	}
+	return err
+}
+
+// sftpFile closes the sftp session together with the file
+type sftpFile struct {
+	*sftp.File
+	client *sftp.Client
+	stop   func()
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	return n, cancelledErr(err)
+}
+
+func (f *sftpFile) Close() error {
+	f.stop()
+	f.File.Close()
+	return f.client.Close()
+}
+
+func (s *sshSource) connect(u *url.URL) (*ssh.Client, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+	username := u.User.Username()
+	if username == "" {
+		if current, err := user.Current(); err == nil {
+			username = current.Username
+		}
+	}
+
+	key := username + "@" + host
+	s.mu.Lock()
+	conn, ok := s.clients[key]
+	s.mu.Unlock()
+	if ok {
+		return conn, nil
+	}
+
+	// dialed without holding the lock, so that a slow host doesn't hold up
+	// the workers fetching from other hosts
+	config, agentConn, err := sshConfig(username, u.User)
+	if err != nil {
+		return nil, err
+	}
+	conn, err = dialSSH(host, config)
+	// the agent is only asked for signatures during the handshake
+	if agentConn != nil {
+		agentConn.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if other, ok := s.clients[key]; ok {
+		// another worker connected to the host in the meantime
+		conn.Close()
+		return other, nil
+	}
+	if s.clients == nil {
+		s.clients = map[string]*ssh.Client{}
+	}
+	s.clients[key] = conn
+	return conn, nil
+}
+
+// dialSSH connects like ssh.Dial, but gives up once the run is interrupted
+func dialSSH(host string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: config.Timeout}
+	netConn, err := dialer.DialContext(rootCtx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	// a host that accepts, but never answers, times out like one that
+	// doesn't accept
+	if config.Timeout > 0 {
+		netConn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	stop := closeOnCancel(netConn)
+	c, chans, reqs, err := ssh.NewClientConn(netConn, host, config)
+	stop()
+	netConn.SetDeadline(time.Time{})
+	if err != nil {
+		netConn.Close()
+		return nil, cancelledErr(err)
+	}
+	if cancelled() {
+		c.Close()
+		return nil, rootCtx.Err()
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// drop closes a client, that failed to open a session, and removes it from
+// the cache, so the next sample gets a new connection instead of a dead one
+func (s *sshSource) drop(conn *ssh.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, c := range s.clients {
+		if c == conn {
+			delete(s.clients, key)
+		}
+	}
+	conn.Close()
+}
+
+// sshConfig authenticates with the key given by "-ssh-key", the ssh-agent and
+// a password from the URI, in this order. Host keys are checked against
+// "-ssh-known-hosts", unless "-insecure" is set. The connection to the agent
+// is returned as well, it has to be closed after dialing.
+func sshConfig(username string, userinfo *url.Userinfo) (*ssh.ClientConfig, net.Conn, error) {
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !options.Insecure {
+		knownHosts := options.SSHKnownHosts
+		if knownHosts == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, nil, err
+			}
+			knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		callback, err := knownhosts.New(knownHosts)
+		if err != nil {
+			return nil, nil, err
+		}
+		hostKeyCallback = callback
+	}
+
+	auth := []ssh.AuthMethod{}
+	if options.SSHKey != "" {
+		key, err := ioutil.ReadFile(options.SSHKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	var agentConn net.Conn
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			agentConn = conn
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if pw, ok := userinfo.Password(); ok {
+		auth = append(auth, ssh.Password(pw))
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         options.ConnectTimeout,
+	}, agentConn, nil
+}
+
+// scpFetch runs "scp -f" in a new session on the remote host and reads a
+// single file in the scp protocol from it
+func scpFetch(session *ssh.Session, name string) (io.ReadCloser, string, error) {
+	stop := closeOnCancel(session)
+	fail := func(err error) (io.ReadCloser, string, error) {
+		stop()
+		session.Close()
+		return nil, "", cancelledErr(err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return fail(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return fail(err)
+	}
+	err = session.Start("scp -f " + shellQuote(name))
+	if err != nil {
+		return fail(err)
+	}
+
+	// signal that we are ready, the remote answers with "C<mode> <size> <name>"
+	r := bufio.NewReader(stdout)
+	if _, err := stdin.Write([]byte{0}); err != nil {
+		return fail(err)
+	}
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return fail(err)
+	}
+	if len(header) == 0 || header[0] != 'C' {
+		return fail(errors.New("scp: " + strings.TrimSpace(strings.TrimLeft(header, "\x01\x02"))))
+	}
+	fields := strings.SplitN(strings.TrimSpace(header), " ", 3)
+	if len(fields) != 3 {
+		return fail(fmt.Errorf("scp: unexpected header %q", header))
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := stdin.Write([]byte{0}); err != nil {
+		return fail(err)
+	}
+
+	return &scpFile{r: r, remaining: size, session: session, stdin: stdin, stop: stop}, fields[2], nil
+}
+
+// scpFile acknowledges the transfer and ends the session, when it is closed
+type scpFile struct {
+	r         *bufio.Reader
+	remaining int64 // bytes of the file, that were not read yet
+	status    error // of the remote after the file, once it was read
+	session   *ssh.Session
+	stdin     io.WriteCloser
+	stop      func()
+}
+
+// Read returns io.EOF only after the remote confirmed, that it sent the
+// whole file
+func (f *scpFile) Read(p []byte) (int, error) {
+	if f.remaining <= 0 {
+		if f.status == nil {
+			f.status = scpStatus(f.r)
+		}
+		return 0, cancelledErr(f.status)
+	}
+	if int64(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.r.Read(p)
+	f.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, cancelledErr(err)
+}
+
+// scpStatus reads the status byte, that follows a file: 0 if it was sent
+// completely, or 1 (warning) or 2 (error) followed by a message. A complete
+// file ends with io.EOF.
+func scpStatus(r *bufio.Reader) error {
+	status, err := r.ReadByte()
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	switch status {
+	case 0:
+		return io.EOF
+	case 1, 2:
+		msg, _ := r.ReadString('\n')
+		return errors.New("scp: " + strings.TrimSpace(msg))
+	}
+	return fmt.Errorf("scp: unexpected status %d after the file", status)
+}
+
+func (f *scpFile) Close() error {
+	f.stop()
+	f.stdin.Write([]byte{0})
+	f.stdin.Close()
+	return f.session.Close()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPTemplateSource(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	setupClient()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/samples/aaaa":
+			w.Write([]byte("plain"))
+		case "/samples/a%20b":
+			w.Header().Set("Content-Disposition", `attachment; filename="../real.exe"`)
+			w.Write([]byte("named"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	options.HTTPSources = `{"vs": "` + srv.URL + `/samples/{hash}"}`
+	sampleSources = map[string]SampleSource{}
+	initSources()
+
+	tests := []struct {
+		line, wantName, wantContent, wantErr string
+	}{
+		{"vs:aaaa", "aaaa", "plain", ""},
+		{"vs:a b", "real.exe", "named", ""},
+		{"vs:missing", "", "", "Couldn't download file (404)"},
+	}
+	for _, tt := range tests {
+		r, name, err := openSample(tt.line)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: err = %v, want %q", tt.line, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.line, err)
+			continue
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		if name != tt.wantName || string(content) != tt.wantContent {
+			t.Errorf("%s: got %s with %q, want %s with %q", tt.line, name, content, tt.wantName, tt.wantContent)
+		}
+	}
+}
+
+func TestS3EscapePath(t *testing.T) {
+	tests := []struct{ path, want string }{
+		{"/bucket/key", "/bucket/key"},
+		{"/bucket/a b/ü+(1)//x/", "/bucket/a%20b/%C3%BC%2B%281%29//x/"},
+		{"/bucket/~user/x-y_z.txt", "/bucket/~user/x-y_z.txt"},
+		{"/bucket/a=b&c*d", "/bucket/a%3Db%26c%2Ad"},
+	}
+	for _, tt := range tests {
+		if got := s3EscapePath(tt.path); got != tt.want {
+			t.Errorf("s3EscapePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestS3Sign(t *testing.T) {
+	s := &s3Source{AccessKey: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	req, _ := http.NewRequest("GET", "https://s3.example.com/", nil)
+	req.URL.Path = "/bucket/a b/ü+(1)//x/"
+	s.sign(req, time.Date(2013, 5, 24, 0, 0, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20130524/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, " +
+		"Signature=c31dc4f563954caaa6a8dfb9343725c3f0046c813eb58fd59d1d2271df86050c"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %q, want %q", got, want)
+	}
+}
+
+func TestS3Source(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	setupClient()
+
+	var requested, auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested, auth = r.RequestURI, r.Header.Get("Authorization")
+		w.Write([]byte("object"))
+	}))
+	defer srv.Close()
+
+	s := &s3Source{Endpoint: srv.URL + "/prefix/", AccessKey: "AKIDEXAMPLE", SecretKey: "secret"}
+	u, _ := url.Parse("s3://bucket/dir//a b+c/")
+	r, _, err := s.Open(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	// the key is sent as it is signed, neither cleaned nor encoded differently
+	if want := "/prefix/bucket/dir//a%20b%2Bc/"; requested != want {
+		t.Errorf("requested %s, want %s", requested, want)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+		t.Errorf("request is not signed: %q", auth)
+	}
+}
+
+// silentHost accepts connections, but never answers the SSH handshake
+func silentHost(t *testing.T) (string, <-chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	accepted := make(chan struct{}, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+			accepted <- struct{}{}
+		}
+	}()
+	return l.Addr().String(), accepted
+}
+
+func TestSSHConnect(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	t.Setenv("SSH_AUTH_SOCK", "")
+	options.Insecure = true
+	ctx, cancel := context.WithCancel(context.Background())
+	saved := rootCtx
+	rootCtx = ctx
+	defer func() { rootCtx = saved }()
+
+	s := &sshSource{}
+	errs := make(chan error, 2)
+	connect := func(host string) {
+		_, err := s.connect(&url.URL{Scheme: "sftp", User: url.User("test"), Host: host, Path: "/a.exe"})
+		errs <- err
+	}
+
+	// a host that hangs in the handshake doesn't hold up the next one
+	slow, slowAccepted := silentHost(t)
+	other, otherAccepted := silentHost(t)
+	go connect(slow)
+	<-slowAccepted
+	go connect(other)
+	select {
+	case <-otherAccepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connecting to the second host waited for the first")
+	}
+
+	// both handshakes are aborted by the interrupt
+	cancel()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("connect = %v, want it to be cancelled", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect wasn't aborted by the interrupt")
+		}
+	}
+	if len(s.clients) != 0 {
+		t.Errorf("cached %d connections, want none", len(s.clients))
+	}
+
+	// without an interrupt, a silent host times out
+	rootCtx = saved
+	options.ConnectTimeout = 100 * time.Millisecond
+	go connect(slow)
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("connected to a host, that never answered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handshake didn't time out")
+	}
+}
+
+func TestSCPFile(t *testing.T) {
+	setupRun(t, newFakeGateway(t))
+	for _, c := range []struct {
+		stream string
+		want   string
+		err    string
+	}{
+		{"data\x00", "data", ""},
+		{"da", "da", "unexpected EOF"},
+		{"data", "data", "unexpected EOF"},
+		{"data\x02scp: read error\n", "data", "scp: read error"},
+		{"data\x07", "data", "unexpected status 7"},
+	} {
+		f := &scpFile{r: bufio.NewReader(strings.NewReader(c.stream)), remaining: 4}
+		got, err := ioutil.ReadAll(f)
+		if string(got) != c.want || (err == nil) != (c.err == "") || (err != nil && !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("reading %q = %q, %v, want %q and %q", c.stream, got, err, c.want, c.err)
+		}
+	}
+}
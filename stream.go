@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamHeader precedes every sample of a "records" stream. It is a line of
+// json, followed by exactly Size bytes of content.
+type streamHeader struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Source  string    `json:"source"`
+	Comment string    `json:"comment"`
+	Tags    []string  `json:"tags"`
+	Date    time.Time `json:"date"`
+}
+
+// PAX records of tar entries, that are taken as metadata
+const (
+	paxSource  = "holmes.source"
+	paxComment = "holmes.comment"
+	paxTags    = "holmes.tags" // json list
+	paxDate    = "holmes.date" // RFC 3339
+)
+
+// a streamed sample waiting for a worker
+type streamEntry struct {
+	content []byte
+	meta    sampleMeta
+}
+
+var (
+	streamEntries   = map[string]*streamEntry{} // by sample name, like stream:<number>/<name>
+	streamEntriesMu sync.Mutex
+)
+
+// streamSource hands the samples read by readStream, readPCAP and queueMail
+// to the workers. Each sample is kept in memory only until a worker took it.
+type streamSource struct{}
+
+func (streamSource) Open(u *url.URL) (io.ReadCloser, string, error) {
+	name := u.String()
+	streamEntriesMu.Lock()
+	e, ok := streamEntries[name]
+	delete(streamEntries, name)
+	streamEntriesMu.Unlock()
+	if !ok {
+		return nil, "", fmt.Errorf("%s is not part of the stream", name)
+	}
+	return &sampleFile{ReadCloser: ioutil.NopCloser(bytes.NewReader(e.content)), meta: e.meta}, e.meta.Name, nil
+}
+
+// readStream uploads all samples of "-stream", either stdin ("-") or a file
+// like a named pipe
+func readStream(in *input) {
+	var r io.Reader = os.Stdin
+	if options.Stream != "-" {
+		f, err := os.Open(options.Stream)
+		if err != nil {
+			warning.Println("Couldn't open stream:", err)
+			return
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var err error
+	switch options.StreamFormat {
+	case "tar":
+		err = readTarStream(in, r)
+	case "records":
+		err = readRecordStream(in, r)
+	default:
+		err = fmt.Errorf("unknown format %q", options.StreamFormat)
+	}
+	if err != nil && !cancelled() {
+		// samples that were already queued are still uploaded
+		warning.Println("stream error:", err)
+	}
+}
+
+func readTarStream(in *input, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for n := 1; !cancelled(); {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		meta := sampleMeta{
+			Name:    path.Base(header.Name),
+			Path:    strings.TrimPrefix(path.Clean(header.Name), "/"),
+			Source:  header.PAXRecords[paxSource],
+			Comment: header.PAXRecords[paxComment],
+		}
+		if options.DateFrom == "mtime" {
+			meta.Date = header.ModTime
+		}
+		if v, ok := header.PAXRecords[paxTags]; ok {
+			if err := json.Unmarshal([]byte(v), &meta.Tags); err != nil {
+				return fmt.Errorf("tags of %s: %s", header.Name, err)
+			}
+		}
+		if v, ok := header.PAXRecords[paxDate]; ok {
+			if meta.Date, err = time.Parse(time.RFC3339, v); err != nil {
+				return fmt.Errorf("date of %s: %s", header.Name, err)
+			}
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		queueStreamEntry(in, "stream", fmt.Sprintf("%d/%s", n, meta.Path), &streamEntry{content: content, meta: meta})
+		n++
+	}
+	return nil
+}
+
+func readRecordStream(in *input, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for n := 1; !cancelled(); n++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		header := &streamHeader{}
+		if err := json.Unmarshal(line, header); err != nil {
+			return fmt.Errorf("invalid record header: %s", err)
+		}
+		if header.Name == "" || header.Size < 0 {
+			return errors.New("record header needs a name and a size")
+		}
+
+		// the size is not trusted to allocate the content up front
+		var content bytes.Buffer
+		if _, err := io.CopyN(&content, br, header.Size); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("content of %s: %s", header.Name, err)
+		}
+		meta := sampleMeta{
+			Name:    path.Base(header.Name),
+			Source:  header.Source,
+			Comment: header.Comment,
+			Tags:    header.Tags,
+			Date:    header.Date,
+		}
+		queueStreamEntry(in, "stream", fmt.Sprintf("%d/%s", n, header.Name), &streamEntry{content: content.Bytes(), meta: meta})
+	}
+	return nil
+}
+
+// queueStreamEntry hands a streamed sample to the workers under the name
+// <scheme>:<name>, if it wasn't uploaded before resuming and matches "-mime".
+// The name has to be unique within the run, as it is the key of the log.
+func queueStreamEntry(in *input, scheme, name string, e *streamEntry) {
+	sample := scheme + ":" + name
+	if u, err := url.Parse(sample); err != nil || u.String() != sample {
+		// e.g. names with "#" or "?", they have to survive openSample
+		name = (&url.URL{Path: name}).EscapedPath()
+		sample = scheme + ":" + name
+	}
+	if resume {
+		if _, already_processed := processed[sample]; already_processed {
+			queueSample(in, sample)
+			return
+		}
+	}
+
+	mimetype := ""
+	if in.Mime != "" {
+		mimetype, _ = mimeTypeByBuffer(e.content)
+		if !strings.Contains(mimetype, in.Mime) {
+			excludeSample(in, sample, mimetype, "mime-type doesn't match")
+			return
+		}
+	}
+	streamEntriesMu.Lock()
+	streamEntries[sample] = e
+	streamEntriesMu.Unlock()
+
+	if dryRun {
+		planSample(in, sample, mimetype, "")
+		return
+	}
+	queueSample(in, sample)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Toolbox/holmes"
+)
+
+// rootCtx is cancelled on the first interrupt. Running requests are aborted,
+// no new samples are queued and the run finishes as usual, so the log-file and
+// report stay complete. A second interrupt quits immediately.
+var rootCtx = context.Background()
+
+func initCancel() {
+	ctx, cancel := context.WithCancel(context.Background())
+	rootCtx = ctx
+
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigC
+		signal.Stop(sigC)
+		warning.Println("Interrupted, cancelling running requests. Interrupt again to quit immediately")
+		cancel()
+	}()
+}
+
+// cancelled reports whether the run was interrupted
+func cancelled() bool {
+	return rootCtx.Err() != nil
+}
+
+// closeOnCancel closes c once the run is interrupted, which aborts reads and
+// writes that would otherwise block until a remote answers. The returned
+// function stops watching, it has to be called when c is done.
+func closeOnCancel(c io.Closer) (stop func()) {
+	done, interrupted := make(chan struct{}), rootCtx.Done()
+	go func() {
+		select {
+		case <-interrupted:
+			c.Close()
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// timeoutFlags registers the flags of the http timeouts, for all subcommands
+// talking to a master-gateway
+func timeoutFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&options.ConnectTimeout, "connect-timeout", 30*time.Second, "Timeout for connecting to a server, 0 disables it")
+	fs.DurationVar(&options.TLSTimeout, "tls-timeout", 10*time.Second, "Timeout for the TLS handshake, 0 disables it")
+	fs.DurationVar(&options.HeaderTimeout, "header-timeout", 5*time.Minute, "Timeout for the response of a server after sending a request, 0 disables it")
+	fs.DurationVar(&options.RequestTimeout, "timeout", 30*time.Minute, "Timeout for a whole request including reading the response, 0 disables it")
+}
+
+// newTransport returns the transport of the global http client
+func newTransport() *http.Transport {
+	tr := &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: options.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   options.TLSTimeout,
+		ResponseHeaderTimeout: options.HeaderTimeout,
+	}
+	if options.Insecure {
+		// Disable SSL verification
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return tr
+}
+
+// failedRequestClass returns the error class of a request that got no
+// complete response
+func failedRequestClass(err error) string {
+	switch {
+	case holmes.IsTimeout(err):
+		return errTimeout
+	case errors.Is(err, context.Canceled):
+		return errCanceled
+	}
+	return errNetwork
+}
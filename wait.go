@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// waitRecord is a line of the results file written in wait mode
+type waitRecord struct {
+	SHA256  string          `json:"sha256"`
+	Service string          `json:"service_name"`
+	Result  json.RawMessage `json:"result"`
+}
+
+// startResultConsumer connects to Totem's results queue, if results should be
+// read from the broker instead of polling Holmes-Storage. It has to be called
+// before submitting the tasks, so that no result is missed.
+func startResultConsumer() *resultConsumer {
+	if options.AMQPURI == "" || options.ResultsExchange == "" {
+		return nil
+	}
+	consumer, err := newResultConsumer(options.AMQPURI, options.ResultsExchange, options.ResultsKey)
+	if err != nil {
+		warning.Fatal("Couldn't consume results:", err)
+	}
+	return consumer
+}
+
+// waitForResults blocks until a result for every service of every task has
+// arrived, options.WaitTimeout passed or the run was interrupted. All results are written to the
+// results file as json lines. Results are read from consumer if it is not
+// nil, otherwise Holmes-Storage is polled.
+func waitForResults(allTasks []Task, consumer *resultConsumer) {
+	// sha256 -> service -> still pending
+	pending := map[string]map[string]bool{}
+	for _, task := range allTasks {
+		if pending[task.PrimaryURI] == nil {
+			pending[task.PrimaryURI] = map[string]bool{}
+		}
+		for service := range task.Tasks {
+			pending[task.PrimaryURI][strings.ToUpper(service)] = true
+		}
+	}
+
+	outName := options.ResultsOut
+	if outName == "" {
+		os.Mkdir("log", 0755)
+		outName = time.Now().Format("log/Holmes-Toolbox_results_2006-01-02_15:04:05.jsonl")
+	}
+	out, err := os.OpenFile(outName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		warning.Fatal("Could not open results file:\n", err)
+	}
+	defer out.Close()
+	info.Println("writing results to", outName)
+
+	// record writes the result, if it was still pending in this run
+	record := func(sha256sum, service string, result []byte) {
+		if !pending[sha256sum][service] {
+			return
+		}
+		delete(pending[sha256sum], service)
+		if len(pending[sha256sum]) == 0 {
+			delete(pending, sha256sum)
+		}
+
+		if !json.Valid(result) {
+			result, _ = json.Marshal(string(result))
+		}
+		line, err := json.Marshal(waitRecord{SHA256: sha256sum, Service: service, Result: result})
+		if err != nil {
+			warning.Println("Couldn't encode result:", err)
+			return
+		}
+		_, err = out.Write(append(line, '\n'))
+		if err != nil {
+			warning.Fatal(err)
+		}
+		info.Printf("Received %s result for %s\n", service, sha256sum)
+	}
+
+	info.Printf("Waiting up to %s for results...\n", options.WaitTimeout)
+	deadline := time.After(options.WaitTimeout)
+
+	if consumer != nil {
+		defer consumer.Close()
+
+	consume:
+		for len(pending) > 0 {
+			select {
+			case d, ok := <-consumer.deliveries:
+				if !ok {
+					warning.Println("Lost connection to the broker while waiting for results")
+					break consume
+				}
+				r := &totemResult{}
+				if err := json.Unmarshal(d.Body, r); err != nil {
+					warning.Println("Couldn't parse result:", err)
+					consumer.settle(d, false)
+					continue
+				}
+				sha256sum := r.SHA256
+				if _, ok := pending[sha256sum]; !ok {
+					sha256sum = r.Filename
+				}
+				record(sha256sum, strings.ToUpper(r.ServiceName), d.Body)
+				consumer.settle(d, true)
+			case <-deadline:
+				warning.Println("Timeout while waiting for results")
+				break consume
+			case <-rootCtx.Done():
+				warning.Println("Interrupted while waiting for results")
+				break consume
+			}
+		}
+	} else {
+		ticker := time.NewTicker(options.PollInterval)
+		defer ticker.Stop()
+
+	poll:
+		for len(pending) > 0 {
+			for sha256sum, services := range pending {
+				for service := range services {
+					if cancelled() {
+						warning.Println("Interrupted while waiting for results")
+						break poll
+					}
+					result, err := fetchResult(sha256sum, service)
+					if err != nil {
+						warning.Printf("Polling %s result for %s failed: %s\n", service, sha256sum, err)
+						continue
+					}
+					if result != nil {
+						record(sha256sum, service, result)
+					}
+				}
+			}
+			if len(pending) == 0 {
+				break
+			}
+
+			select {
+			case <-ticker.C:
+			case <-deadline:
+				warning.Println("Timeout while waiting for results")
+				break poll
+			case <-rootCtx.Done():
+				warning.Println("Interrupted while waiting for results")
+				break poll
+			}
+		}
+	}
+
+	printMissingResults(pending)
+}
+
+// fetchResult asks Holmes-Storage for the result of a service. A nil result
+// without error means, that it did not arrive yet.
+func fetchResult(sha256sum, service string) ([]byte, error) {
+	uri := strings.NewReplacer("{sha256}", sha256sum, "{service}", service).Replace(options.ResultsURI)
+	req, err := http.NewRequestWithContext(rootCtx, "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer SafeResponseClose(resp)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Holmes-Storage returned %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// an empty list means, that there are no results yet
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("[]")) || bytes.Equal(trimmed, []byte("null")) {
+		return nil, nil
+	}
+	return body, nil
+}
+
+// printMissingResults lists all services, that did not return a result for
+// at least one sample
+func printMissingResults(pending map[string]map[string]bool) {
+	if len(pending) == 0 {
+		info.Println("All results arrived")
+		return
+	}
+
+	missing := map[string][]string{}
+	for sha256sum, services := range pending {
+		for service := range services {
+			missing[service] = append(missing[service], sha256sum)
+		}
+	}
+	services := make([]string, 0, len(missing))
+	for service := range missing {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	warning.Println("The following services never returned:")
+	for _, service := range services {
+		sort.Strings(missing[service])
+		warning.Printf("%s (%d samples): %s\n", service, len(missing[service]), strings.Join(missing[service], ", "))
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rakyll/magicmime"
+)
+
+// policies of "-symlinks"
+const (
+	symlinksFiles  = "files"  // links to files are samples, linked directories are not walked
+	symlinksFollow = "follow" // linked directories are walked as well
+	symlinksSkip   = "skip"   // links are ignored
+)
+
+// like "-workers", these are not restored from a log-file
+var (
+	scanWorkers int // goroutines listing directories, and as many detecting mime-types
+	scanAhead   int // samples of an input that wait for the upload workers
+)
+
+// walker walks the directory of an input, by the policies of "-symlinks",
+// "-skip-hidden" and "-one-fs". Directories are listed by up to scanWorkers
+// goroutines, the regular files found are handed to as many goroutines that
+// detect their mime-type and queue them.
+type walker struct {
+	in     *input
+	device uint64 // of the root, for "-one-fs"
+
+	mu      sync.Mutex
+	visited map[string]bool // real paths of the directories walked so far
+
+	slots chan struct{}    // of the goroutines listing directories, besides the first
+	dirs  sync.WaitGroup   // directories that are still listed
+	files chan scannedFile // nil in a dry run, files are typed while walking
+}
+
+// scannedFile is a regular file found by the walk, fi follows symlinks
+type scannedFile struct {
+	path string
+	fi   os.FileInfo
+}
+
+// walkDirectory queues the samples of a "-dir"
+func walkDirectory(in *input) {
+	fi, err := os.Stat(in.root)
+	if err != nil {
+		warning.Println("walk error:", describePathError(err))
+		return
+	}
+	w := &walker{in: in, device: deviceOf(fi), visited: map[string]bool{}}
+	if dryRun {
+		// the plan lists the files in the order of the walk
+		w.walkDir(in.root)
+		return
+	}
+
+	workers := scanWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	w.slots = make(chan struct{}, workers-1)
+	w.files = make(chan scannedFile, workers)
+	var typers sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		typers.Add(1)
+		go func() {
+			defer typers.Done()
+			w.typeFiles()
+		}()
+	}
+	w.walkDir(in.root)
+	w.dirs.Wait()
+	close(w.files)
+	typers.Wait()
+}
+
+// walkDir visits all entries of a directory in lexical order. Subdirectories
+// are listed concurrently and files are typed by several workers, so the
+// samples are only queued in that order in a dry run.
+func (w *walker) walkDir(dir string) {
+	start := time.Now()
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		w.mu.Lock()
+		walked := w.visited[real]
+		w.visited[real] = true
+		w.mu.Unlock()
+		if walked {
+			warning.Printf("Not walking %s, %s was already walked (symlink loop?)\n", dir, real)
+			return
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	recordStage(&report.Stages.Walk, time.Since(start))
+	if err != nil {
+		warning.Println("Skipping directory:", describePathError(err))
+		excludeSample(w.in, dir, "", describePathError(err))
+		return
+	}
+	for _, fi := range entries {
+		if cancelled() {
+			return
+		}
+		w.visit(filepath.Join(dir, fi.Name()), fi)
+	}
+}
+
+// visit applies the policies to an entry of a directory, fi is its lstat
+func (w *walker) visit(path string, fi os.FileInfo) {
+	if options.SkipHidden && strings.HasPrefix(fi.Name(), ".") {
+		excludeSample(w.in, path, "", "hidden")
+		return
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if options.Symlinks == symlinksSkip {
+			excludeSample(w.in, path, "", "symlink")
+			return
+		}
+		start := time.Now()
+		target, err := os.Stat(path)
+		recordStage(&report.Stages.Walk, time.Since(start))
+		if err != nil {
+			warning.Println("Skipping symlink:", describePathError(err))
+			excludeSample(w.in, path, "", "broken symlink: "+describePathError(err))
+			return
+		}
+		if target.IsDir() && options.Symlinks != symlinksFollow {
+			excludeSample(w.in, path, "", "symlink to a directory")
+			return
+		}
+		fi = target
+	}
+
+	if options.OneFilesystem && deviceOf(fi) != w.device {
+		excludeSample(w.in, path, "", "on another filesystem")
+		return
+	}
+	if fi.IsDir() {
+		if options.Recursive {
+			w.walkSubdir(path)
+		}
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		// sockets, FIFOs and devices would block or never end
+		excludeSample(w.in, path, "", "not a regular file ("+fileType(fi.Mode())+")")
+		return
+	}
+	if w.files == nil {
+		walkFile(w.in, path, fi, mimeTypeByFile)
+		return
+	}
+	w.files <- scannedFile{path, fi}
+}
+
+// walkSubdir lists a directory in a goroutine of its own if one is free,
+// otherwise right away
+func (w *walker) walkSubdir(dir string) {
+	select {
+	case w.slots <- struct{}{}:
+		w.dirs.Add(1)
+		go func() {
+			defer func() {
+				<-w.slots
+				w.dirs.Done()
+			}()
+			w.walkDir(dir)
+		}()
+	default:
+		w.walkDir(dir)
+	}
+}
+
+// typeFiles queues the files found by the walk, with a libmagic handle of its
+// own so that mime-types are detected in parallel
+func (w *walker) typeFiles() {
+	typeByFile := mimeTypeByFile
+	decoder, err := magicmime.NewDecoder(magicmime.MAGIC_MIME_TYPE | magicmime.MAGIC_SYMLINK | magicmime.MAGIC_ERROR)
+	if err != nil {
+		debug.Println("Sharing libmagic, because it can't be opened again:", err)
+	} else {
+		defer decoder.Close()
+		typeByFile = decoder.TypeByFile
+	}
+	for f := range w.files {
+		if cancelled() {
+			// drain, so that the walk isn't blocked
+			continue
+		}
+		walkFile(w.in, f.path, f.fi, typeByFile)
+	}
+}
+
+// walkFile queues a regular file found in the directory of an input
+func walkFile(in *input, path string, fi os.FileInfo, typeByFile func(string) (string, error)) {
+	if isSidecar(path) {
+		excludeSample(in, path, "", "metadata of another sample")
+		return
+	}
+	if resume {
+		state, already_processed := processed[path]
+		if already_processed {
+			if dryRun {
+				excludeSample(in, path, "", "already uploaded")
+				return
+			}
+			wg.Add(1)
+			skipSample(in, path, state)
+			return
+		}
+	}
+
+	start := time.Now()
+	mimetype, err := typeByFile(path)
+	recordStage(&report.Stages.MIME, time.Since(start))
+	if err != nil {
+		// libmagic doesn't say why, opening the file does
+		if f, openErr := os.Open(path); openErr != nil {
+			err = errors.New(describePathError(openErr))
+		} else {
+			f.Close()
+		}
+		warning.Println("mimetype error (skipping "+path+"):", err)
+		excludeSample(in, path, "", "mimetype error: "+err.Error())
+		return
+	}
+	if options.Mail && isMail(path, mimetype) {
+		// the attachments are filtered by "-mime" instead
+		excludeSample(in, path, mimetype, "mail, its attachments are uploaded")
+		queueMail(in, path, fi)
+		return
+	}
+	if strings.Contains(mimetype, in.Mime) {
+		includeSample(in, path, mimetype)
+	} else {
+		excludeSample(in, path, mimetype, "mime-type doesn't match")
+	}
+}
+
+// describePathError spells out permission problems, which are the most common
+// reason a part of a corpus can't be read
+func describePathError(err error) string {
+	if pe, ok := err.(*os.PathError); ok && os.IsPermission(err) {
+		return fmt.Sprintf("permission denied to %s %s", pe.Op, pe.Path)
+	}
+	return err.Error()
+}
+
+func deviceOf(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+	return 0
+}
+
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	}
+	return "irregular"
+}
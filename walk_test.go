@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+func TestWalkPolicies(t *testing.T) {
+	tests := []struct {
+		symlinks   string
+		skipHidden bool
+		want       []string
+	}{
+		{symlinksFiles, false, []string{".hidden.exe", "a.exe", "link.exe"}},
+		{symlinksFollow, false, []string{".hidden.exe", "a.exe", "link.exe", "o.exe"}},
+		{symlinksSkip, false, []string{".hidden.exe", "a.exe"}},
+		{symlinksFiles, true, []string{"a.exe", "link.exe"}},
+	}
+	for _, tt := range tests {
+		g := newFakeGateway(t)
+		dir := setupRun(t, g)
+		writeFile(t, "samples/a.exe", "aaa")
+		writeFile(t, "samples/.hidden.exe", "hhh")
+		writeFile(t, "outside/o.exe", "ooo")
+		os.MkdirAll("samples/sub", 0755)
+		for link, target := range map[string]string{
+			"samples/link.exe": "../outside/o.exe",
+			"samples/linkdir":  "../outside",
+			"samples/sub/loop": "..",
+			"samples/dangling": "nowhere",
+		} {
+			if err := os.Symlink(target, link); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := syscall.Mkfifo("samples/fifo", 0644); err != nil {
+			t.Fatal(err)
+		}
+		options.Directory = pathList{filepath.Join(dir, "samples")}
+		options.Recursive = true
+		options.Symlinks = tt.symlinks
+		options.SkipHidden = tt.skipHidden
+
+		runUpload(t)
+
+		if names := uploadedNames(g); !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("-symlinks %s -skip-hidden=%v uploaded %v, want %v", tt.symlinks, tt.skipHidden, names, tt.want)
+		}
+	}
+}
+
+func TestDescribePathError(t *testing.T) {
+	err := &os.PathError{Op: "open", Path: "/samples/a.exe", Err: os.ErrPermission}
+	if got, want := describePathError(err), "permission denied to open /samples/a.exe"; got != want {
+		t.Errorf("describePathError = %q, want %q", got, want)
+	}
+}
+
+func TestParallelWalk(t *testing.T) {
+	g := newFakeGateway(t)
+	dir := setupRun(t, g)
+	want := []string{}
+	for d := 0; d < 8; d++ {
+		for f := 0; f < 5; f++ {
+			name := fmt.Sprintf("s%d-%d.exe", d, f)
+			writeFile(t, fmt.Sprintf("samples/%d/sub/%s", d, name), name)
+			want = append(want, name)
+		}
+	}
+	sort.Strings(want)
+	options.Directory = pathList{filepath.Join(dir, "samples")}
+	options.Recursive = true
+	scanWorkers, scanAhead = 4, 3
+	defer func() { scanWorkers, scanAhead = 0, 0 }()
+
+	codes := runUpload(t)
+
+	if names := uploadedNames(g); !reflect.DeepEqual(names, want) {
+		t.Errorf("uploaded %v, want %v", names, want)
+	}
+	if len(codes) != len(want) {
+		t.Errorf("logged %d samples, want %d", len(codes), len(want))
+	}
+	if report.Stages.Walk == 0 || report.Stages.Upload == 0 {
+		t.Errorf("stages = %+v, want the time of the walk and the uploads", report.Stages)
+	}
+}
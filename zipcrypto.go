@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// writeEncryptedZip writes an archive containing a single file, encrypted
+// with the traditional PKWARE scheme ("ZipCrypto"). It is weak, but it is
+// what everybody uses to keep malware from being opened by accident, and
+// every unzip tool can read it.
+func writeEncryptedZip(w io.Writer, name string, content []byte, password string, modified time.Time) error {
+	compressed := &bytes.Buffer{}
+	fw, err := flate.NewWriter(compressed, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	if _, err = fw.Write(content); err != nil {
+		return err
+	}
+	if err = fw.Close(); err != nil {
+		return err
+	}
+
+	crc := crc32.ChecksumIEEE(content)
+	keys := newZipKeys(password)
+
+	// the encryption header is random, except for the last byte, which is
+	// used to check the password
+	header := make([]byte, 12)
+	if _, err = rand.Read(header[:11]); err != nil {
+		return err
+	}
+	header[11] = byte(crc >> 24)
+
+	encrypted := make([]byte, 0, len(header)+compressed.Len())
+	encrypted = append(encrypted, keys.encrypt(header)...)
+	encrypted = append(encrypted, keys.encrypt(compressed.Bytes())...)
+
+	zw := zip.NewWriter(w)
+	fh := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Deflate,
+		Flags:              0x1, // encrypted
+		CRC32:              crc,
+		CompressedSize64:   uint64(len(encrypted)),
+		UncompressedSize64: uint64(len(content)),
+		Modified:           modified,
+	}
+	raw, err := zw.CreateRaw(fh)
+	if err != nil {
+		return err
+	}
+	if _, err = raw.Write(encrypted); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+type zipKeys [3]uint32
+
+func newZipKeys(password string) *zipKeys {
+	k := &zipKeys{0x12345678, 0x23456789, 0x34567890}
+	for i := 0; i < len(password); i++ {
+		k.update(password[i])
+	}
+	return k
+}
+
+func (k *zipKeys) update(b byte) {
+	k[0] = crc32Update(k[0], b)
+	k[1] = (k[1]+(k[0]&0xff))*134775813 + 1
+	k[2] = crc32Update(k[2], byte(k[1]>>24))
+}
+
+func (k *zipKeys) encrypt(plain []byte) []byte {
+	out := make([]byte, len(plain))
+	for i, b := range plain {
+		t := k[2] | 2
+		out[i] = b ^ byte((t*(t^1))>>8)
+		k.update(b)
+	}
+	return out
+}
+
+func crc32Update(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[byte(crc)^b] ^ (crc >> 8)
+}